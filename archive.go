@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// legacyArchiveExtension is a tar.gz holding the .sql file, written by older versions
+const legacyArchiveExtension = ".sql.tar.gz"
+
+// ArchiveWriter compresses, and optionally encrypts, a dump into an archive file while it is being generated,
+// so the uncompressed dump never touches the disk
+type ArchiveWriter struct {
+	file         *os.File
+	compressor   io.WriteCloser
+	encryptor    io.WriteCloser
+	hash         hash.Hash
+	size         int64
+	uncompressed int64
+}
+
+// CreateArchive returns a new ArchiveWriter writing to filename with the codec called codecName.
+// When recipients are given the compressed stream is encrypted to them with age.
+func CreateArchive(filename string, codecName string, level int, recipients []age.Recipient) (*ArchiveWriter, error) {
+	codec, ok := GetCodec(codecName)
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", codecName)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ArchiveWriter{file: file, hash: sha256.New()}
+	var w io.Writer = io.MultiWriter(a.hash, writerFunc(func(p []byte) (int, error) {
+		n, err := file.Write(p)
+		a.size += int64(n)
+		return n, err
+	}))
+
+	if len(recipients) > 0 {
+		if a.encryptor, err = age.Encrypt(w, recipients...); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("age: %v", err)
+		}
+		w = a.encryptor
+	}
+
+	a.compressor, err = codec.NewWriter(w, level)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (a *ArchiveWriter) Write(p []byte) (int, error) {
+	n, err := a.compressor.Write(p)
+	a.uncompressed += int64(n)
+	return n, err
+}
+
+// Close flushes the compressor and the encryptor and closes the archive file
+func (a *ArchiveWriter) Close() error {
+	err := a.compressor.Close()
+	if a.encryptor != nil {
+		if e := a.encryptor.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := a.file.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Size returns the size of the archive file
+func (a *ArchiveWriter) Size() int64 {
+	return a.size
+}
+
+// UncompressedSize returns the size of the dump written to the archive
+func (a *ArchiveWriter) UncompressedSize() int64 {
+	return a.uncompressed
+}
+
+// SHA256 returns the checksum of the archive file, valid after Close
+func (a *ArchiveWriter) SHA256() string {
+	return hex.EncodeToString(a.hash.Sum(nil))
+}
+
+// IsArchive tells if name is a backup archive, encrypted or not
+func IsArchive(name string) bool {
+	name = strings.TrimSuffix(name, EncryptedExtension)
+	_, ok := CodecForFile(name)
+	return ok || strings.HasSuffix(name, legacyArchiveExtension)
+}
+
+// ArchiveBase strips the archive extension, leaving {DATABASE_NAME}_{TABLENAME{INDEX}|SCHEMA|DATA|ALL}_{TIMESTAMP}
+func ArchiveBase(name string) string {
+	name = strings.TrimSuffix(name, EncryptedExtension)
+	if strings.HasSuffix(name, legacyArchiveExtension) {
+		return strings.TrimSuffix(name, legacyArchiveExtension)
+	}
+	if codec, ok := CodecForFile(name); ok {
+		return strings.TrimSuffix(name, codec.Extension)
+	}
+	return name
+}
+
+// archiveReader reads the dump stored in an archive and closes every layer underneath it
+type archiveReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (a *archiveReader) Close() error {
+	var err error
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		if e := a.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// OpenArchive opens an archive and returns a reader of the dump it holds,
+// identities are only needed for encrypted archives
+func OpenArchive(filename string, identities []age.Identity) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := NewArchiveReader(file, filename, identities)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &archiveReader{Reader: reader, closers: []io.Closer{file, reader}}, nil
+}
+
+// NewArchiveReader decompresses r, the content of the archive name, with the codec matching its extension
+// and returns a reader of the dump. Reading it up to io.EOF validates the whole archive:
+// the checksum of the codec, the authentication of encrypted archives and, for tar.gz, the tar framing.
+func NewArchiveReader(r io.Reader, name string, identities []age.Identity) (io.ReadCloser, error) {
+	if IsEncrypted(name) {
+		if len(identities) == 0 {
+			return nil, fmt.Errorf("%s: archive is encrypted, an identity or passphrase is required", name)
+		}
+
+		decrypted, err := age.Decrypt(r, identities...)
+		if err != nil {
+			return nil, fmt.Errorf("age: %v", err)
+		}
+		r, name = decrypted, strings.TrimSuffix(name, EncryptedExtension)
+	}
+
+	if !strings.HasSuffix(name, legacyArchiveExtension) {
+		codec, ok := CodecForFile(name)
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown archive extension", name)
+		}
+
+		reader, err := codec.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", codec.Name, err)
+		}
+		return reader, nil
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v", err)
+	}
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			gr.Close()
+			return nil, fmt.Errorf("%s: archive is empty", name)
+		}
+		if err != nil {
+			gr.Close()
+			return nil, fmt.Errorf("tar: %v", err)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			return &tarFileReader{tar: tr, decompressor: gr}, nil
+		}
+	}
+}
+
+// tarFileReader reads the single file of a tar stream and checks nothing but the end of the archive follows it
+type tarFileReader struct {
+	tar          *tar.Reader
+	decompressor io.ReadCloser
+	done         bool
+}
+
+func (t *tarFileReader) Read(p []byte) (int, error) {
+	if t.done {
+		return 0, io.EOF
+	}
+
+	n, err := t.tar.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	t.done = true
+
+	if _, err := t.tar.Next(); err != io.EOF {
+		if err == nil {
+			return n, fmt.Errorf("tar: archive holds more than one file")
+		}
+		return n, fmt.Errorf("tar: %v", err)
+	}
+
+	// reading up to the end makes gzip check its checksum
+	if _, err := io.Copy(ioutil.Discard, t.decompressor); err != nil {
+		return n, fmt.Errorf("gzip: %v", err)
+	}
+
+	return n, io.EOF
+}
+
+func (t *tarFileReader) Close() error {
+	return t.decompressor.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+)
+
+// Chunk model for one part of a split table dump
+type Chunk struct {
+	Index int
+	Where string
+}
+
+// integerTypes are the information_schema DATA_TYPE values a table can be split on by range
+var integerTypes = map[string]bool{
+	"tinyint":   true,
+	"smallint":  true,
+	"mediumint": true,
+	"int":       true,
+	"integer":   true,
+	"bigint":    true,
+}
+
+// GetChunkKey returns the column of the primary key, or else of the first unique index, when the index
+// has a single NOT NULL integer column. The leading column of a composite key is not unique and is never used.
+// An empty name means the table has no usable key.
+func GetChunkKey(q queryer, database string, table string) (string, error) {
+	rows, err := q.Query(`SELECT s.INDEX_NAME, s.COLUMN_NAME, c.DATA_TYPE, c.IS_NULLABLE
+		FROM information_schema.STATISTICS s
+		JOIN information_schema.COLUMNS c ON c.TABLE_SCHEMA = s.TABLE_SCHEMA AND c.TABLE_NAME = s.TABLE_NAME AND c.COLUMN_NAME = s.COLUMN_NAME
+		WHERE s.TABLE_SCHEMA = ? AND s.TABLE_NAME = ? AND s.NON_UNIQUE = 0 AND s.SEQ_IN_INDEX = 1
+		AND (SELECT COUNT(*) FROM information_schema.STATISTICS k
+			WHERE k.TABLE_SCHEMA = s.TABLE_SCHEMA AND k.TABLE_NAME = s.TABLE_NAME AND k.INDEX_NAME = s.INDEX_NAME) = 1
+		ORDER BY s.INDEX_NAME = 'PRIMARY' DESC, s.INDEX_NAME`, database, table)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var index, column, dataType, nullable string
+		if err := rows.Scan(&index, &column, &dataType, &nullable); err != nil {
+			return "", err
+		}
+
+		if integerTypes[dataType] && nullable == "NO" {
+			return column, nil
+		}
+	}
+
+	return "", rows.Err()
+}
+
+// chunkBoundaries walks the index on column and returns the key value starting every batchSize rows.
+// It fails when a boundary is not greater than the previous one, the column then holds duplicates.
+func chunkBoundaries(q queryer, table string, column string, batchSize int) ([]string, error) {
+	var first sql.NullString
+	if err := q.QueryRow(fmt.Sprintf("SELECT MIN(%s) FROM %s", quoteIdentifier(column), quoteIdentifier(table))).Scan(&first); err != nil {
+		return nil, err
+	}
+
+	if !first.Valid {
+		return nil, nil
+	}
+
+	boundaries := []string{first.String}
+	query := fmt.Sprintf("SELECT %[1]s FROM %[2]s WHERE %[1]s >= ? ORDER BY %[1]s LIMIT 1 OFFSET %[3]d", quoteIdentifier(column), quoteIdentifier(table), batchSize)
+
+	for {
+		var next string
+		err := q.QueryRow(query, boundaries[len(boundaries)-1]).Scan(&next)
+		if err == sql.ErrNoRows {
+			return boundaries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		previous := boundaries[len(boundaries)-1]
+		if !integerGreater(next, previous) {
+			return nil, fmt.Errorf("key column %s is not unique, %s follows %s", column, next, previous)
+		}
+
+		boundaries = append(boundaries, next)
+	}
+}
+
+// integerGreater tells if the integer a is greater than the integer b, both as returned by mysql
+func integerGreater(a string, b string) bool {
+	x, okx := new(big.Int).SetString(a, 10)
+	y, oky := new(big.Int).SetString(b, 10)
+	return okx && oky && x.Cmp(y) > 0
+}
+
+// rangeChunks turns key boundaries into WHERE clauses covering the whole key space,
+// the first chunk has no lower bound and the last one no upper bound
+func rangeChunks(column string, boundaries []string) []Chunk {
+	if len(boundaries) <= 1 {
+		return []Chunk{{Index: 1}}
+	}
+
+	column = quoteIdentifier(column)
+
+	var chunks []Chunk
+	for i := range boundaries {
+		var where string
+		switch {
+		case i == 0:
+			where = fmt.Sprintf("%s < %s", column, boundaries[1])
+		case i == len(boundaries)-1:
+			where = fmt.Sprintf("%s >= %s", column, boundaries[i])
+		default:
+			where = fmt.Sprintf("%s >= %s AND %s < %s", column, boundaries[i], column, boundaries[i+1])
+		}
+
+		chunks = append(chunks, Chunk{Index: i + 1, Where: where})
+	}
+
+	return chunks
+}
+
+// limitChunks is the LIMIT offset pagination used for tables without a usable key
+func limitChunks(rowCount int, batchSize int) []Chunk {
+	var chunks []Chunk
+
+	index := 1
+	for counter := 0; counter <= rowCount; counter += batchSize {
+		chunks = append(chunks, Chunk{Index: index, Where: fmt.Sprintf("1=1 LIMIT %d, %d", counter, batchSize)})
+		index++
+	}
+
+	return chunks
+}
+
+// GetTableChunks splits table on its primary key (or unique integer index) into ranges of options.BatchSize rows,
+// falling back to LIMIT offset pagination when the table has no usable key
+func GetTableChunks(options Options, db string, table Table) []Chunk {
+	var conn *sql.DB
+	dsn, err := nativeDataSourceName(options, db)
+	if err == nil {
+		conn, err = sql.Open("mysql", dsn)
+	}
+	if err != nil {
+		printEvent("error to connect for chunking "+db+"."+table.TableName+", using LIMIT pagination: "+err.Error(), options.Verbosity, Warning, LogFields{"database": db, "table": table.TableName})
+		return limitChunks(table.RowCount, options.BatchSize)
+	}
+	defer conn.Close()
+
+	column, err := GetChunkKey(conn, db, table.TableName)
+	if err != nil {
+		printEvent("error to read keys of "+db+"."+table.TableName+", using LIMIT pagination: "+err.Error(), options.Verbosity, Warning, LogFields{"database": db, "table": table.TableName})
+		return limitChunks(table.RowCount, options.BatchSize)
+	}
+
+	if column == "" {
+		printEvent("No integer primary or unique key on "+db+"."+table.TableName+", using LIMIT pagination", options.Verbosity, Warning, LogFields{"database": db, "table": table.TableName})
+		return limitChunks(table.RowCount, options.BatchSize)
+	}
+
+	boundaries, err := chunkBoundaries(conn, table.TableName, column, options.BatchSize)
+	if err != nil {
+		printEvent("error to compute key ranges of "+db+"."+table.TableName+", using LIMIT pagination: "+err.Error(), options.Verbosity, Warning, LogFields{"database": db, "table": table.TableName})
+		return limitChunks(table.RowCount, options.BatchSize)
+	}
+
+	chunks := rangeChunks(column, boundaries)
+	printEvent(fmt.Sprintf("Splitting %s.%s on key column %s into %d chunks", db, table.TableName, column, len(chunks)), options.Verbosity, Info, LogFields{"database": db, "table": table.TableName, "chunks": len(chunks)})
+
+	return chunks
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIntegerGreater(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2", "1", true},
+		{"1", "1", false},
+		{"1", "2", false},
+		{"10", "9", true},
+		{"-1", "-2", true},
+		{"18446744073709551615", "18446744073709551614", true},
+		{"abc", "1", false},
+	}
+
+	for _, test := range tests {
+		if got := integerGreater(test.a, test.b); got != test.want {
+			t.Errorf("integerGreater(%s, %s) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestRangeChunks(t *testing.T) {
+	tests := []struct {
+		name       string
+		boundaries []string
+		want       []Chunk
+	}{
+		{"empty table", nil, []Chunk{{Index: 1}}},
+		{"single chunk", []string{"1"}, []Chunk{{Index: 1}}},
+		{"three chunks", []string{"1", "1001", "2001"}, []Chunk{
+			{Index: 1, Where: "`id` < 1001"},
+			{Index: 2, Where: "`id` >= 1001 AND `id` < 2001"},
+			{Index: 3, Where: "`id` >= 2001"},
+		}},
+	}
+
+	for _, test := range tests {
+		if got := rangeChunks("id", test.boundaries); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: rangeChunks = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLimitChunks(t *testing.T) {
+	want := []Chunk{
+		{Index: 1, Where: "1=1 LIMIT 0, 10"},
+		{Index: 2, Where: "1=1 LIMIT 10, 10"},
+		{Index: 3, Where: "1=1 LIMIT 20, 10"},
+	}
+
+	if got := limitChunks(25, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("limitChunks = %v, want %v", got, want)
+	}
+}
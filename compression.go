@@ -0,0 +1,174 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Codec model for a compression format of the archives
+type Codec struct {
+	Name         string
+	Extension    string
+	DefaultLevel int
+	MinLevel     int
+	MaxLevel     int
+
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// DefaultCodec is the codec used when -compression is not given
+const DefaultCodec = "gzip"
+
+// xzDictionarySizes are the dictionary sizes of the xz command line presets 0 to 9
+var xzDictionarySizes = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// lz4Levels maps the levels 0 to 9 to the lz4 package compression levels, the default level 0 is the fast mode
+var lz4Levels = []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+
+// Codecs lists the supported compression formats. Extensions are matched in order, so none comes last.
+var Codecs = []Codec{
+	{
+		Name:         "gzip",
+		Extension:    ".sql.gz",
+		DefaultLevel: gzip.DefaultCompression,
+		MinLevel:     gzip.HuffmanOnly,
+		MaxLevel:     gzip.BestCompression,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		Name:         "zstd",
+		Extension:    ".sql.zst",
+		DefaultLevel: 3,
+		MinLevel:     1,
+		MaxLevel:     22,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	{
+		Name:         "xz",
+		Extension:    ".sql.xz",
+		DefaultLevel: 6,
+		MinLevel:     0,
+		MaxLevel:     9,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return xz.WriterConfig{DictCap: xzDictionarySizes[level]}.NewWriter(w)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			reader, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(reader), nil
+		},
+	},
+	{
+		Name:         "lz4",
+		Extension:    ".sql.lz4",
+		DefaultLevel: 0,
+		MinLevel:     0,
+		MaxLevel:     9,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			writer := lz4.NewWriter(w)
+			if err := writer.Apply(lz4.CompressionLevelOption(lz4Levels[level])); err != nil {
+				return nil, err
+			}
+			return writer, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(lz4.NewReader(r)), nil
+		},
+	},
+	{
+		Name:      "none",
+		Extension: ".sql",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	},
+}
+
+// nopWriteCloser adds a Close method doing nothing to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// GetCodec returns the codec called name
+func GetCodec(name string) (Codec, bool) {
+	for _, codec := range Codecs {
+		if codec.Name == name {
+			return codec, true
+		}
+	}
+	return Codec{}, false
+}
+
+// CodecForFile returns the codec of an archive from its extension
+func CodecForFile(name string) (Codec, bool) {
+	for _, codec := range Codecs {
+		if strings.HasSuffix(name, codec.Extension) {
+			return codec, true
+		}
+	}
+	return Codec{}, false
+}
+
+// ParseCompression parses a -compression value, codec[:level], and checks the level is supported by the codec
+func ParseCompression(value string) (string, int, error) {
+	name, level := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		name, level = value[:i], value[i+1:]
+	}
+
+	codec, ok := GetCodec(name)
+	if !ok {
+		var names []string
+		for _, codec := range Codecs {
+			names = append(names, codec.Name)
+		}
+		return "", 0, fmt.Errorf("unknown compression %q, supported are %s", name, strings.Join(names, ", "))
+	}
+
+	if level == "" {
+		return codec.Name, codec.DefaultLevel, nil
+	}
+
+	n, err := strconv.Atoi(level)
+	if err != nil {
+		return "", 0, fmt.Errorf("compression level %q is not a number", level)
+	}
+
+	if n < codec.MinLevel || n > codec.MaxLevel {
+		return "", 0, fmt.Errorf("compression level of %s must be between %d and %d", codec.Name, codec.MinLevel, codec.MaxLevel)
+	}
+
+	return codec.Name, n, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateArchiveRoundTrip(t *testing.T) {
+	for _, codec := range Codecs {
+		t.Run(codec.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := "shop_ALL_20170805" + codec.Extension
+
+			file := writeTestArchive(t, dir, name, codec.Name, nil, testDump)
+			if file.UncompressedSize != int64(len(testDump)) {
+				t.Errorf("UncompressedSize = %d, want %d", file.UncompressedSize, len(testDump))
+			}
+
+			if found, ok := CodecForFile(name); !ok || found.Name != codec.Name {
+				t.Errorf("CodecForFile(%s) = %s, %t, want %s", name, found.Name, ok, codec.Name)
+			}
+
+			reader, err := OpenArchive(filepath.Join(dir, name), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != testDump {
+				t.Errorf("archive holds %q, want %q", content, testDump)
+			}
+		})
+	}
+}
+
+func TestCreateArchiveLevels(t *testing.T) {
+	for _, codec := range Codecs {
+		for _, level := range []int{codec.MinLevel, codec.MaxLevel} {
+			archive, err := CreateArchive(filepath.Join(t.TempDir(), "shop_ALL_20170805"+codec.Extension), codec.Name, level, nil)
+			if err != nil {
+				t.Errorf("CreateArchive(%s, level %d): %v", codec.Name, level, err)
+				continue
+			}
+			if err := archive.Close(); err != nil {
+				t.Errorf("Close(%s, level %d): %v", codec.Name, level, err)
+			}
+		}
+	}
+}
+
+func TestCreateArchiveUnknownCodec(t *testing.T) {
+	if _, err := CreateArchive(filepath.Join(t.TempDir(), "shop_ALL_20170805.sql.bz2"), "bzip2", 0, nil); err == nil {
+		t.Errorf("CreateArchive with an unknown codec succeeded")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigProfile model for one server profile of a config file. Values are keyed by flag name.
+type ConfigProfile struct {
+	Name   string
+	Values map[string]string
+}
+
+// configFile model for the YAML config file: defaults apply to every profile, profile values override them
+type configFile struct {
+	Defaults map[string]interface{}   `yaml:"defaults"`
+	Profiles []map[string]interface{} `yaml:"profiles"`
+}
+
+// configReservedKeys are flags that can not be set from a config file, the flags of mars prune included
+var configReservedKeys = map[string]bool{"config": true, "profiles": true, "test": true, "dry-run": true, "report": true}
+
+// configDefaultsKeys are flags that can only be set in the defaults of a config file, as the log is shared by every profile
+var configDefaultsKeys = map[string]bool{"log-format": true, "log-file": true}
+
+// LoadConfig reads the profiles of the config file filename, only those listed in names when it is not empty.
+// Without a config file it returns one profile without values, so the flags alone are used.
+func LoadConfig(filename string, names string) ([]ConfigProfile, error) {
+	if filename == "" {
+		if names != "" {
+			return nil, fmt.Errorf("-profiles requires -config")
+		}
+		return []ConfigProfile{{}}, nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var config configFile
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if len(config.Profiles) == 0 {
+		return nil, fmt.Errorf("%s: no profiles", filename)
+	}
+
+	defaults, err := configValues(config.Defaults)
+	if err != nil {
+		return nil, fmt.Errorf("%s: defaults: %v", filename, err)
+	}
+
+	selected := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected[name] = true
+		}
+	}
+
+	var profiles []ConfigProfile
+	seen := map[string]bool{}
+
+	for i, raw := range config.Profiles {
+		values, err := configValues(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: profile %d: %v", filename, i+1, err)
+		}
+
+		name := values["name"]
+		delete(values, "name")
+
+		if name == "" {
+			return nil, fmt.Errorf("%s: profile %d has no name", filename, i+1)
+		}
+		for key := range values {
+			if configDefaultsKeys[key] {
+				return nil, fmt.Errorf("%s: profile %s: %s can only be set in defaults", filename, name, key)
+			}
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s: profile %s is defined twice", filename, name)
+		}
+		seen[name] = true
+
+		if len(selected) > 0 && !selected[name] {
+			continue
+		}
+		delete(selected, name)
+
+		profile := ConfigProfile{Name: name, Values: map[string]string{}}
+		for key, value := range defaults {
+			profile.Values[key] = value
+		}
+		for key, value := range values {
+			profile.Values[key] = value
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	for name := range selected {
+		return nil, fmt.Errorf("%s: unknown profile %s", filename, name)
+	}
+
+	return profiles, nil
+}
+
+// configValues converts the YAML values of a profile to flag values, lists become comma separated values
+func configValues(raw map[string]interface{}) (map[string]string, error) {
+	values := map[string]string{}
+
+	for key, value := range raw {
+		if configReservedKeys[key] {
+			return nil, fmt.Errorf("%s can not be set in a config file", key)
+		}
+
+		switch v := value.(type) {
+		case nil:
+			values[key] = ""
+		case []interface{}:
+			var items []string
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s must be a value or a list", key)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+
+	return values, nil
+}
+
+// Apply resets flags to their default value and sets the values of the profile,
+// except for the flags given on the command line listed in explicit
+func (p ConfigProfile) Apply(flags *flag.FlagSet, explicit map[string]bool) error {
+	for key := range p.Values {
+		if flags.Lookup(key) == nil {
+			return fmt.Errorf("profile %s: unknown option %s", p.Name, key)
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || err != nil {
+			return
+		}
+
+		value, ok := p.Values[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+
+		if e := f.Value.Set(value); e != nil {
+			err = fmt.Errorf("profile %s: invalid value %q for %s: %v", p.Name, value, f.Name, e)
+		}
+	})
+
+	return err
+}
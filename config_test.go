@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a config file in a temporary directory and returns its name
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "mars.yml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// testFlags returns a flag set with a few backup flags and the flags given on arguments
+func testFlags(t *testing.T, arguments ...string) (*flag.FlagSet, map[string]bool) {
+	t.Helper()
+	flags := flag.NewFlagSet("mars", flag.ContinueOnError)
+	flags.String("hostname", "localhost", "")
+	flags.String("databases", "", "")
+	flags.Int("parallel", 1, "")
+	flags.Bool("consistent", false, "")
+	flags.String("compression", DefaultCodec, "")
+
+	if err := flags.Parse(arguments); err != nil {
+		t.Fatal(err)
+	}
+
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	return flags, explicit
+}
+
+const testConfig = `
+defaults:
+  compression: zstd
+  parallel: 4
+profiles:
+  - name: production
+    hostname: db1.example.com
+    databases: [shop, billing]
+    consistent: true
+  - name: reporting
+    hostname: db2.example.com
+    parallel: 2
+`
+
+func TestConfigPrecedence(t *testing.T) {
+	profiles, err := LoadConfig(writeConfig(t, testConfig), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("LoadConfig returned %d profiles, want 2", len(profiles))
+	}
+
+	tests := []struct {
+		name      string
+		arguments []string
+		want      map[string]map[string]string
+	}{
+		{
+			name: "profile values",
+			want: map[string]map[string]string{
+				"production": {"hostname": "db1.example.com", "databases": "shop,billing", "parallel": "4", "consistent": "true", "compression": "zstd"},
+				"reporting":  {"hostname": "db2.example.com", "databases": "", "parallel": "2", "consistent": "false", "compression": "zstd"},
+			},
+		},
+		{
+			name:      "explicit flags",
+			arguments: []string{"-parallel", "8", "-compression", "gzip"},
+			want: map[string]map[string]string{
+				"production": {"hostname": "db1.example.com", "databases": "shop,billing", "parallel": "8", "consistent": "true", "compression": "gzip"},
+				"reporting":  {"hostname": "db2.example.com", "databases": "", "parallel": "8", "consistent": "false", "compression": "gzip"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags, explicit := testFlags(t, test.arguments...)
+
+			// the profiles are applied in turn to the same flags, none may leak into the next
+			for _, profile := range profiles {
+				if err := profile.Apply(flags, explicit); err != nil {
+					t.Fatal(err)
+				}
+
+				for name, want := range test.want[profile.Name] {
+					if got := flags.Lookup(name).Value.String(); got != want {
+						t.Errorf("%s: %s = %q, want %q", profile.Name, name, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	profiles, err := LoadConfig(writeConfig(t, "profiles:\n  - name: minimal\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags, explicit := testFlags(t, "-hostname", "db3.example.com")
+	if err := profiles[0].Apply(flags, explicit); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"hostname": "db3.example.com", "parallel": "1", "compression": DefaultCodec}
+	for name, value := range want {
+		if got := flags.Lookup(name).Value.String(); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestConfigSelectedProfiles(t *testing.T) {
+	profiles, err := LoadConfig(writeConfig(t, testConfig), " reporting ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || profiles[0].Name != "reporting" {
+		t.Errorf("LoadConfig returned %v, want the reporting profile", profiles)
+	}
+
+	if _, err := LoadConfig(writeConfig(t, testConfig), "staging"); err == nil {
+		t.Errorf("LoadConfig with an unknown profile succeeded")
+	}
+
+	if _, err := LoadConfig("", "production"); err == nil {
+		t.Errorf("LoadConfig with -profiles and no config file succeeded")
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"no profiles", "defaults:\n  parallel: 2\n", "no profiles"},
+		{"profile without name", "profiles:\n  - hostname: db1\n", "no name"},
+		{"duplicate profile", "profiles:\n  - name: a\n  - name: a\n", "twice"},
+		{"reserved key", "profiles:\n  - name: a\n    config: other.yml\n", "can not be set"},
+		{"log in a profile", "profiles:\n  - name: a\n    log-format: json\n", "only be set in defaults"},
+		{"nested value", "profiles:\n  - name: a\n    hostname:\n      primary: db1\n", "value or a list"},
+		{"invalid YAML", "profiles: [", "mars.yml"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, test.content), "")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("LoadConfig error = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestConfigApplyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown key", "profiles:\n  - name: a\n    hostnme: db1\n", "unknown option hostnme"},
+		{"invalid value", "profiles:\n  - name: a\n    parallel: many\n", "invalid value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profiles, err := LoadConfig(writeConfig(t, test.content), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			flags, explicit := testFlags(t)
+			if err := profiles[0].Apply(flags, explicit); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Apply error = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
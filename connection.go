@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TLS modes, named after the --ssl-mode values of the mysql clients
+const (
+	// TLSDisabled never uses TLS
+	TLSDisabled = "disabled"
+
+	// TLSPreferred uses TLS when the server supports it, without checking its certificate
+	TLSPreferred = "preferred"
+
+	// TLSRequired fails when the server does not support TLS, without checking its certificate
+	TLSRequired = "required"
+
+	// TLSVerifyCA also checks the server certificate is signed by the CA
+	TLSVerifyCA = "verify-ca"
+
+	// TLSVerifyIdentity also checks the server certificate is issued for the host name
+	TLSVerifyIdentity = "verify-identity"
+)
+
+// DefaultCharset is the connection character set when -charset is not given
+const DefaultCharset = "utf8mb4"
+
+// Connection model for the settings of a connection to the mysql server,
+// translated the same way into the DSN of the driver and the options of mysqldump and mysql
+type Connection struct {
+	HostName string
+	Bind     string
+	Socket   string
+	UserName string
+	Password string
+	TLSMode  string
+	TLSCA    string
+	TLSCert  string
+	TLSKey   string
+	Charset  string
+}
+
+var (
+	tlsConfigs      = map[string]bool{}
+	tlsConfigsMutex sync.Mutex
+)
+
+// defineConnectionFlags adds the socket, TLS and charset flags of c to flags
+func defineConnectionFlags(flags *flag.FlagSet, c *Connection) {
+	flags.StringVar(&c.Socket, "socket", "", "Unix socket of the mysql server, used instead of hostname and bind")
+	flags.StringVar(&c.TLSMode, "tls-mode", "", "TLS mode: disabled, preferred, required, verify-ca or verify-identity. Default is the default of each client")
+	flags.StringVar(&c.TLSCA, "tls-ca", "", "CA certificate file checking the server certificate")
+	flags.StringVar(&c.TLSCert, "tls-cert", "", "Client certificate file")
+	flags.StringVar(&c.TLSKey, "tls-key", "", "Client private key file")
+	flags.StringVar(&c.Charset, "charset", DefaultCharset, "Character set of the connection and of the dump files")
+}
+
+// Validate checks the TLS settings are consistent
+func (c Connection) Validate() error {
+	switch c.TLSMode {
+	case "", TLSDisabled, TLSPreferred, TLSRequired, TLSVerifyCA, TLSVerifyIdentity:
+	default:
+		return fmt.Errorf("unknown tls-mode %q", c.TLSMode)
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls-cert and tls-key must be given together")
+	}
+
+	if c.TLSCert != "" && c.TLSMode != TLSRequired && c.TLSMode != TLSVerifyCA && c.TLSMode != TLSVerifyIdentity {
+		return fmt.Errorf("a client certificate requires tls-mode required, verify-ca or verify-identity")
+	}
+
+	if c.TLSMode == TLSVerifyCA && c.TLSCA == "" {
+		return fmt.Errorf("tls-mode verify-ca requires tls-ca")
+	}
+
+	return nil
+}
+
+// DataSourceName returns the go-sql-driver DSN of database. Extra params are added to the DSN.
+func (c Connection) DataSourceName(database string, params map[string]string) (string, error) {
+	config := mysql.NewConfig()
+	config.User = c.UserName
+	config.Passwd = c.Password
+	config.DBName = database
+
+	if c.Socket != "" {
+		config.Net = "unix"
+		config.Addr = c.Socket
+	} else {
+		config.Net = "tcp"
+		config.Addr = c.HostName + ":" + c.Bind
+	}
+
+	config.Params = map[string]string{"charset": c.Charset}
+	for key, value := range params {
+		config.Params[key] = value
+	}
+
+	tlsConfig, err := c.driverTLSConfig()
+	if err != nil {
+		return "", err
+	}
+	config.TLSConfig = tlsConfig
+
+	return config.FormatDSN(), nil
+}
+
+// driverTLSConfig returns the value of the tls DSN parameter, registering a custom configuration when needed
+func (c Connection) driverTLSConfig() (string, error) {
+	switch c.TLSMode {
+	case "":
+		return "", nil
+	case TLSDisabled:
+		return "false", nil
+	case TLSPreferred:
+		return "preferred", nil
+	}
+
+	config := &tls.Config{}
+
+	if c.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return "", err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("%s: no certificate found", c.TLSCA)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.TLSCert != "" {
+		certificate, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return "", err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	switch c.TLSMode {
+	case TLSRequired:
+		config.InsecureSkipVerify = true
+	case TLSVerifyCA:
+		// the chain is checked against the CA but not the host name
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateChain(rawCerts, config.RootCAs)
+		}
+	case TLSVerifyIdentity:
+		config.ServerName = c.HostName
+	}
+
+	// configurations are registered once under a name derived from the settings
+	hash := sha256.Sum256([]byte(strings.Join([]string{c.TLSMode, c.TLSCA, c.TLSCert, c.TLSKey, c.HostName}, "\x00")))
+	name := "mars-" + hex.EncodeToString(hash[:8])
+
+	tlsConfigsMutex.Lock()
+	defer tlsConfigsMutex.Unlock()
+
+	if !tlsConfigs[name] {
+		if err := mysql.RegisterTLSConfig(name, config); err != nil {
+			return "", err
+		}
+		tlsConfigs[name] = true
+	}
+
+	return name, nil
+}
+
+// verifyCertificateChain checks the server certificate chain against roots, ignoring the host name
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("server sent no certificate")
+	}
+
+	var certificates []*x509.Certificate
+	for _, raw := range rawCerts {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	_, err := certificates[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// ClientArgs returns the options of mysqldump and mysql for the connection, the credentials excepted
+// as they are passed in an option file
+func (c Connection) ClientArgs() []string {
+	var args []string
+
+	if c.Socket != "" {
+		args = append(args, "--protocol=SOCKET", "--socket="+c.Socket)
+	} else {
+		args = append(args, "--protocol=TCP", "-h"+c.HostName, "-P"+c.Bind)
+	}
+
+	if c.TLSMode != "" {
+		args = append(args, "--ssl-mode="+strings.ToUpper(strings.Replace(c.TLSMode, "-", "_", -1)))
+	}
+	if c.TLSCA != "" {
+		args = append(args, "--ssl-ca="+c.TLSCA)
+	}
+	if c.TLSCert != "" {
+		args = append(args, "--ssl-cert="+c.TLSCert, "--ssl-key="+c.TLSKey)
+	}
+
+	args = append(args, "--default-character-set="+c.Charset)
+
+	return args
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key to dir and returns their files
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "db1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &LocalStorage{Root: dir}
+	putString(t, storage, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	putString(t, storage, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+func TestConnectionValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection Connection
+		wantErr    string
+	}{
+		{name: "default", connection: Connection{}},
+		{name: "disabled", connection: Connection{TLSMode: TLSDisabled}},
+		{name: "preferred", connection: Connection{TLSMode: TLSPreferred}},
+		{name: "required", connection: Connection{TLSMode: TLSRequired}},
+		{name: "verify-ca", connection: Connection{TLSMode: TLSVerifyCA, TLSCA: "ca.pem"}},
+		{name: "verify-identity", connection: Connection{TLSMode: TLSVerifyIdentity}},
+		{name: "client certificate", connection: Connection{TLSMode: TLSRequired, TLSCert: "cert.pem", TLSKey: "key.pem"}},
+		{name: "unknown mode", connection: Connection{TLSMode: "strict"}, wantErr: "unknown tls-mode"},
+		{name: "upper case mode", connection: Connection{TLSMode: "REQUIRED"}, wantErr: "unknown tls-mode"},
+		{name: "certificate without key", connection: Connection{TLSMode: TLSRequired, TLSCert: "cert.pem"}, wantErr: "given together"},
+		{name: "key without certificate", connection: Connection{TLSMode: TLSRequired, TLSKey: "key.pem"}, wantErr: "given together"},
+		{name: "certificate without tls", connection: Connection{TLSCert: "cert.pem", TLSKey: "key.pem"}, wantErr: "requires tls-mode"},
+		{name: "certificate with preferred", connection: Connection{TLSMode: TLSPreferred, TLSCert: "cert.pem", TLSKey: "key.pem"}, wantErr: "requires tls-mode"},
+		{name: "verify-ca without ca", connection: Connection{TLSMode: TLSVerifyCA}, wantErr: "requires tls-ca"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.connection.Validate()
+			if test.wantErr == "" && err != nil {
+				t.Errorf("Validate: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("Validate error = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnectionDataSourceName(t *testing.T) {
+	cert, key := writeTestCertificate(t, t.TempDir())
+
+	tests := []struct {
+		name       string
+		connection Connection
+		wantNet    string
+		wantAddr   string
+		wantTLS    string
+		check      func(t *testing.T, config *mysql.Config)
+	}{
+		{
+			name:       "tcp",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4"},
+			wantNet:    "tcp",
+			wantAddr:   "db1:3306",
+		},
+		{
+			name:       "socket",
+			connection: Connection{HostName: "db1", Bind: "3306", Socket: "/run/mysqld/mysqld.sock", Charset: "latin1"},
+			wantNet:    "unix",
+			wantAddr:   "/run/mysqld/mysqld.sock",
+		},
+		{
+			name:       "disabled",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSDisabled},
+			wantNet:    "tcp",
+			wantAddr:   "db1:3306",
+			wantTLS:    "false",
+		},
+		{
+			name:       "preferred",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSPreferred},
+			wantNet:    "tcp",
+			wantAddr:   "db1:3306",
+			wantTLS:    "preferred",
+		},
+		{
+			name:       "required",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSRequired},
+			wantNet:    "tcp",
+			wantAddr:   "db1:3306",
+			wantTLS:    "mars-",
+			check: func(t *testing.T, config *mysql.Config) {
+				if !config.TLS.InsecureSkipVerify || config.TLS.RootCAs != nil {
+					t.Errorf("required checks the server certificate")
+				}
+			},
+		},
+		{
+			name:       "verify-ca",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSVerifyCA, TLSCA: cert},
+			wantNet:    "tcp",
+			wantAddr:   "db1:3306",
+			wantTLS:    "mars-",
+			check: func(t *testing.T, config *mysql.Config) {
+				if config.TLS.RootCAs == nil || config.TLS.VerifyPeerCertificate == nil {
+					t.Errorf("verify-ca does not check the chain against the CA")
+				}
+			},
+		},
+		{
+			name:       "verify-identity with client certificate",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSVerifyIdentity, TLSCA: cert, TLSCert: cert, TLSKey: key},
+			wantNet:    "tcp",
+			wantAddr:   "db1:3306",
+			wantTLS:    "mars-",
+			check: func(t *testing.T, config *mysql.Config) {
+				if config.TLS.InsecureSkipVerify || config.TLS.ServerName != "db1" {
+					t.Errorf("verify-identity does not check the host name: InsecureSkipVerify %t, ServerName %q", config.TLS.InsecureSkipVerify, config.TLS.ServerName)
+				}
+				if len(config.TLS.Certificates) != 1 {
+					t.Errorf("%d client certificates, want 1", len(config.TLS.Certificates))
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.connection.UserName, test.connection.Password = "backup", "s3cret"
+
+			dsn, err := test.connection.DataSourceName("shop", map[string]string{"time_zone": "'+00:00'"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatalf("ParseDSN(%s): %v", dsn, err)
+			}
+
+			if config.Net != test.wantNet || config.Addr != test.wantAddr {
+				t.Errorf("address = %s(%s), want %s(%s)", config.Net, config.Addr, test.wantNet, test.wantAddr)
+			}
+			if config.User != "backup" || config.Passwd != "s3cret" || config.DBName != "shop" {
+				t.Errorf("credentials and database = %s, %s, %s", config.User, config.Passwd, config.DBName)
+			}
+			// the driver parses charset into its own setting
+			if !strings.Contains(dsn, "charset="+test.connection.Charset) {
+				t.Errorf("DSN %s has no charset=%s", dsn, test.connection.Charset)
+			}
+			if want := map[string]string{"time_zone": "'+00:00'"}; !reflect.DeepEqual(config.Params, want) {
+				t.Errorf("params = %v, want %v", config.Params, want)
+			}
+			if !strings.HasPrefix(config.TLSConfig, test.wantTLS) || (test.wantTLS == "") != (config.TLSConfig == "") {
+				t.Errorf("tls = %q, want %q", config.TLSConfig, test.wantTLS)
+			}
+			if test.check != nil {
+				test.check(t, config)
+			}
+		})
+	}
+}
+
+func TestConnectionDataSourceNameMissingCA(t *testing.T) {
+	connection := Connection{HostName: "db1", Bind: "3306", TLSMode: TLSVerifyCA, TLSCA: filepath.Join(t.TempDir(), "missing.pem")}
+	if _, err := connection.DataSourceName("shop", nil); err == nil {
+		t.Errorf("DataSourceName with a missing CA file succeeded")
+	}
+}
+
+func TestConnectionClientArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection Connection
+		want       []string
+	}{
+		{
+			name:       "tcp",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4"},
+			want:       []string{"--protocol=TCP", "-hdb1", "-P3306", "--default-character-set=utf8mb4"},
+		},
+		{
+			name:       "socket",
+			connection: Connection{HostName: "db1", Bind: "3306", Socket: "/run/mysqld/mysqld.sock", Charset: "latin1"},
+			want:       []string{"--protocol=SOCKET", "--socket=/run/mysqld/mysqld.sock", "--default-character-set=latin1"},
+		},
+		{
+			name:       "disabled",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSDisabled},
+			want:       []string{"--protocol=TCP", "-hdb1", "-P3306", "--ssl-mode=DISABLED", "--default-character-set=utf8mb4"},
+		},
+		{
+			name:       "preferred",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSPreferred},
+			want:       []string{"--protocol=TCP", "-hdb1", "-P3306", "--ssl-mode=PREFERRED", "--default-character-set=utf8mb4"},
+		},
+		{
+			name:       "required",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSRequired},
+			want:       []string{"--protocol=TCP", "-hdb1", "-P3306", "--ssl-mode=REQUIRED", "--default-character-set=utf8mb4"},
+		},
+		{
+			name:       "verify-ca",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSVerifyCA, TLSCA: "/etc/mysql/ca.pem"},
+			want:       []string{"--protocol=TCP", "-hdb1", "-P3306", "--ssl-mode=VERIFY_CA", "--ssl-ca=/etc/mysql/ca.pem", "--default-character-set=utf8mb4"},
+		},
+		{
+			name:       "verify-identity with client certificate",
+			connection: Connection{HostName: "db1", Bind: "3306", Charset: "utf8mb4", TLSMode: TLSVerifyIdentity, TLSCA: "/etc/mysql/ca.pem", TLSCert: "/etc/mysql/cert.pem", TLSKey: "/etc/mysql/key.pem"},
+			want:       []string{"--protocol=TCP", "-hdb1", "-P3306", "--ssl-mode=VERIFY_IDENTITY", "--ssl-ca=/etc/mysql/ca.pem", "--ssl-cert=/etc/mysql/cert.pem", "--ssl-key=/etc/mysql/key.pem", "--default-character-set=utf8mb4"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.connection.ClientArgs(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ClientArgs = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// PasswordEnv is the environment variable read for the mysql password, the same the mysql clients use
+const PasswordEnv = "MYSQL_PWD"
+
+// redactedSecret replaces secrets in the log output
+const redactedSecret = "********"
+
+var (
+	secrets      []string
+	secretsMutex sync.Mutex
+)
+
+// registerSecret makes printMessage hide secret from every message
+func registerSecret(secret string) {
+	if secret == "" {
+		return
+	}
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	secrets = append(secrets, secret)
+}
+
+// redactSecrets replaces the registered secrets found in message
+func redactSecrets(message string) string {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	for _, secret := range secrets {
+		message = strings.Replace(message, secret, redactedSecret, -1)
+	}
+
+	return message
+}
+
+// ResolvePassword returns the mysql password from, in order, the -password flag, the output of
+// passwordCommand or the MYSQL_PWD environment variable. The password is registered as a secret.
+func ResolvePassword(password string, passwordCommand string) (string, error) {
+	switch {
+	case password != "":
+	case passwordCommand != "":
+		var stdout, stderr bytes.Buffer
+
+		cmd := exec.Command("/bin/sh", "-c", passwordCommand)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("password command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+
+		password = strings.TrimRight(stdout.String(), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("password command printed nothing")
+		}
+	default:
+		password = os.Getenv(PasswordEnv)
+	}
+
+	registerSecret(password)
+
+	return password, nil
+}
+
+// writeClientOptionFile writes the credentials to a temporary mysql option file readable by the owner only,
+// to be given to the mysql clients with --defaults-extra-file. The caller removes it.
+func writeClientOptionFile(username string, password string) (string, error) {
+	file, err := ioutil.TempFile("", "mars-*.cnf")
+	if err != nil {
+		return "", err
+	}
+
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	_, err = fmt.Fprintf(file, "[client]\nuser=%s\npassword=%s\n", optionFileValue(username), optionFileValue(password))
+	if e := file.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// optionFileValue quotes a value of a mysql option file
+func optionFileValue(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "\\r", "\t", "\\t")
+	return "\"" + replacer.Replace(value) + "\""
+}
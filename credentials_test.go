@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+		message string
+		want    string
+	}{
+		{"no secret", nil, "connecting to db1:3306", "connecting to db1:3306"},
+		{"password", []string{"s3cret"}, "Access denied for s3cret", "Access denied for " + redactedSecret},
+		{"every occurrence", []string{"s3cret"}, "s3cret s3cret", redactedSecret + " " + redactedSecret},
+		{"hash", []string{"pa#ss"}, "password=pa#ss", "password=" + redactedSecret},
+		{"quote", []string{`pa"ss`}, `password="pa"ss"`, `password="` + redactedSecret + `"`},
+		{"backslash", []string{`pa\ss`}, `password=pa\ss`, "password=" + redactedSecret},
+		{"spaces", []string{"pass word"}, "password=pass word;", "password=" + redactedSecret + ";"},
+		{"newline", []string{"pass\nword"}, "password=pass\nword", "password=" + redactedSecret},
+		{"several secrets", []string{"s3cret", "t0ken"}, "s3cret and t0ken", redactedSecret + " and " + redactedSecret},
+		{"empty secret ignored", []string{""}, "nothing to hide", "nothing to hide"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saved := secrets
+			secrets = nil
+			defer func() { secrets = saved }()
+
+			for _, secret := range test.secrets {
+				registerSecret(secret)
+			}
+
+			if got := redactSecrets(test.message); got != test.want {
+				t.Errorf("redactSecrets(%q) = %q, want %q", test.message, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteClientOptionFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     string
+	}{
+		{"plain", "root", "s3cret", "[client]\nuser=\"root\"\npassword=\"s3cret\"\n"},
+		{"hash", "root", "pa#ss", "[client]\nuser=\"root\"\npassword=\"pa#ss\"\n"},
+		{"quote", "root", `pa"ss`, "[client]\nuser=\"root\"\npassword=\"pa\\\"ss\"\n"},
+		{"backslash", "root", `pa\ss`, "[client]\nuser=\"root\"\npassword=\"pa\\\\ss\"\n"},
+		{"spaces", "backup user", " pass word ", "[client]\nuser=\"backup user\"\npassword=\" pass word \"\n"},
+		{"newline", "root", "pass\r\nword\t", "[client]\nuser=\"root\"\npassword=\"pass\\r\\nword\\t\"\n"},
+		{"empty password", "root", "", "[client]\nuser=\"root\"\npassword=\"\"\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename, err := writeClientOptionFile(test.username, test.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(filename)
+
+			content, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.want {
+				t.Errorf("option file = %q, want %q", content, test.want)
+			}
+
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); runtime.GOOS != "windows" && mode != 0600 {
+				t.Errorf("option file mode = %o, want 600", mode)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID returns an identifier shared by the hardlinks of a file, empty when it is unknown
+func fileID(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
+
+// diskFree returns the bytes available to unprivileged users on the filesystem of dir
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
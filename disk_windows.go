@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// fileID is not known on windows, hardlinks are counted once per name
+func fileID(info os.FileInfo) string {
+	return ""
+}
+
+// diskFree is not supported on windows
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("free space is not available on this system")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Dump engines
+const (
+	// EngineMySQLDump shells out to the mysqldump binary
+	EngineMySQLDump = "mysqldump"
+
+	// EngineNative generates the dump with the go-sql-driver connection
+	EngineNative = "native"
+)
+
+// DumpRequest model for the content of one dump file
+type DumpRequest struct {
+	Database     string
+	Tables       []string
+	Where        string
+	NoData       bool
+	NoCreateDB   bool
+	NoCreateInfo bool
+	SkipTriggers bool
+
+	// Snapshot, when set, is the consistent snapshot the native engine reads from
+	Snapshot *Snapshot
+}
+
+// runDump writes the dump described by request to w using the engine selected in options.
+// It returns the number of rows dumped, or -1 when the engine can not count them.
+func runDump(options Options, request DumpRequest, w io.Writer) (int64, error) {
+	if options.Engine == EngineNative {
+		return runNativeDump(options, request, w)
+	}
+
+	return -1, runMySQLDump(options, request, w)
+}
+
+// mysqldumpArgs translates a DumpRequest into mysqldump arguments.
+// The credentials are read from optionFile, which must come first.
+func mysqldumpArgs(options Options, request DumpRequest, optionFile string) []string {
+	var args []string
+	args = append(args, "--defaults-extra-file="+optionFile)
+	args = append(args, options.ClientArgs()...)
+
+	if request.NoData {
+		args = append(args, "--no-data")
+	}
+
+	if request.NoCreateDB {
+		args = append(args, "--no-create-db")
+	}
+
+	if request.SkipTriggers {
+		args = append(args, "--skip-triggers")
+	}
+
+	if request.NoCreateInfo {
+		args = append(args, "--no-create-info")
+	}
+
+	if options.AdditionalMySQLDumpArgs != "" {
+		args = append(args, strings.Split(options.AdditionalMySQLDumpArgs, " ")...)
+	}
+
+	if request.Where != "" {
+		args = append(args, fmt.Sprintf("--where=%s", request.Where))
+	}
+
+	args = append(args, request.Database)
+	args = append(args, request.Tables...)
+
+	return args
+}
+
+// runMySQLDump streams the output of mysqldump into w
+func runMySQLDump(options Options, request DumpRequest, w io.Writer) error {
+	optionFile, err := writeClientOptionFile(options.UserName, options.Password)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(optionFile)
+
+	args := mysqldumpArgs(options, request, optionFile)
+
+	printEvent("mysqldump is being executed with parameters : "+strings.Join(args, " "), options.Verbosity, Info, LogFields{"database": request.Database})
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(options.MySQLDumpPath, args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+
+	if stderr.Len() > 0 {
+		return fmt.Errorf("%s", stderr.String())
+	}
+
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// EncryptedExtension is appended to the codec extension of archives encrypted with age
+const EncryptedExtension = ".age"
+
+// IsEncrypted tells if name is an archive encrypted with age
+func IsEncrypted(name string) bool {
+	return strings.HasSuffix(name, EncryptedExtension)
+}
+
+// readPassphrase reads a passphrase from the first line of filename
+func readPassphrase(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	passphrase := strings.TrimRight(strings.SplitN(string(content), "\n", 2)[0], "\r")
+	if passphrase == "" {
+		return "", fmt.Errorf("%s: passphrase is empty", filename)
+	}
+	registerSecret(passphrase)
+
+	return passphrase, nil
+}
+
+// LoadRecipients returns the age recipients archives are encrypted to, from a recipients file
+// (one age public key per line) or a passphrase file. It returns nil when both are empty.
+func LoadRecipients(recipientsFile string, passphraseFile string) ([]age.Recipient, error) {
+	switch {
+	case recipientsFile != "" && passphraseFile != "":
+		return nil, fmt.Errorf("a recipients file and a passphrase file can not be used together")
+	case recipientsFile != "":
+		file, err := os.Open(recipientsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		recipients, err := age.ParseRecipients(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", recipientsFile, err)
+		}
+		return recipients, nil
+	case passphraseFile != "":
+		passphrase, err := readPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{recipient}, nil
+	}
+
+	return nil, nil
+}
+
+// LoadIdentities returns the age identities used to decrypt archives, from an identity file
+// (age secret keys) and/or a passphrase file. It returns nil when both are empty.
+func LoadIdentities(identityFile string, passphraseFile string) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if identityFile != "" {
+		file, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		parsed, err := age.ParseIdentities(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", identityFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if passphraseFile != "" {
+		passphrase, err := readPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func generateIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+// readTestArchive returns the dump held by the archive dir/name
+func readTestArchive(dir string, name string, identities []age.Identity) (string, error) {
+	reader, err := OpenArchive(filepath.Join(dir, name), identities)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	return string(content), err
+}
+
+func TestEncryptedArchiveRoundTrip(t *testing.T) {
+	identity := generateIdentity(t)
+	other := generateIdentity(t)
+
+	for _, codec := range Codecs {
+		t.Run(codec.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := "shop_ALL_20170805" + codec.Extension + EncryptedExtension
+
+			file := writeTestArchive(t, dir, name, codec.Name, []age.Recipient{identity.Recipient()}, testDump)
+			if !IsEncrypted(name) || !IsArchive(name) || !file.Encrypted {
+				t.Errorf("%s is not recognized as an encrypted archive", name)
+			}
+
+			content, err := readTestArchive(dir, name, []age.Identity{other, identity})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content != testDump {
+				t.Errorf("archive holds %q, want %q", content, testDump)
+			}
+
+			if _, err := readTestArchive(dir, name, []age.Identity{other}); err == nil {
+				t.Errorf("archive opened with a wrong key")
+			}
+
+			if _, err := readTestArchive(dir, name, nil); err == nil {
+				t.Errorf("archive opened without a key")
+			}
+		})
+	}
+}
+
+func TestEncryptedArchivePassphrase(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	recipients, err := LoadRecipients("", writeFile("passphrase", "correct horse battery staple\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "shop_ALL_20170805.sql.zst" + EncryptedExtension
+	writeTestArchive(t, dir, name, "zstd", recipients, testDump)
+
+	identities, err := LoadIdentities("", writeFile("passphrase", "correct horse battery staple\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := readTestArchive(dir, name, identities); err != nil || content != testDump {
+		t.Errorf("archive holds %q, %v, want %q", content, err, testDump)
+	}
+
+	wrong, err := LoadIdentities("", writeFile("wrong", "incorrect horse\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTestArchive(dir, name, wrong); err == nil {
+		t.Errorf("archive opened with a wrong passphrase")
+	}
+}
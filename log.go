@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Log formats
+const (
+	// LogFormatConsole writes the messages as is, colored by level when written to a terminal
+	LogFormatConsole = "console"
+
+	// LogFormatJSON writes one JSON object per event
+	LogFormatJSON = "json"
+
+	// LogFormatLogfmt writes one line of key=value pairs per event
+	LogFormatLogfmt = "logfmt"
+)
+
+// LogFields are the structured fields of an event: database, table, chunk, file, duration, error...
+type LogFields map[string]interface{}
+
+// logFieldOrder lists the fields written first, the others follow in alphabetical order
+var logFieldOrder = []string{"profile", "database", "table", "chunk", "file", "duration", "error"}
+
+var (
+	logFormat           = LogFormatConsole
+	logOutput io.Writer = os.Stdout
+
+	// logConsole receives the events when there is no -log-file, mars prune moves them to stderr to keep stdout for its report
+	logConsole io.Writer = os.Stdout
+)
+
+// printMutex keeps events of concurrent dumps from interleaving
+var printMutex sync.Mutex
+
+// defineLogFlags adds the -log-format and -log-file flags to flags
+func defineLogFlags(flags *flag.FlagSet, format *string, file *string) {
+	flags.StringVar(format, "log-format", LogFormatConsole, "Log format: console, json or logfmt")
+	flags.StringVar(file, "log-file", "", "Append the log to this file instead of stdout")
+}
+
+// SetupLogging sets the format and destination of the events printed afterwards
+func SetupLogging(format string, file string) error {
+	if format != LogFormatConsole && format != LogFormatJSON && format != LogFormatLogfmt {
+		return fmt.Errorf("log-format must be either %s, %s or %s", LogFormatConsole, LogFormatJSON, LogFormatLogfmt)
+	}
+
+	output := logConsole
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		output = f
+	}
+
+	printMutex.Lock()
+	defer printMutex.Unlock()
+
+	logFormat = format
+	logOutput = output
+
+	return nil
+}
+
+// printEvent prints message with its fields when messageType passes verbosity:
+// 2 prints every message, 1 warnings and errors, 0 errors only
+func printEvent(message string, verbosity int, messageType int, fields LogFields) {
+	switch {
+	case verbosity >= 2:
+	case verbosity == 1 && messageType > Info:
+	case verbosity <= 0 && messageType > Warning:
+	default:
+		return
+	}
+
+	message = redactSecrets(message)
+
+	printMutex.Lock()
+	defer printMutex.Unlock()
+
+	switch logFormat {
+	case LogFormatJSON:
+		fmt.Fprintln(logOutput, formatJSONEvent(message, messageType, fields))
+	case LogFormatLogfmt:
+		fmt.Fprintln(logOutput, formatLogfmtEvent(message, messageType, fields))
+	default:
+		if pairs := formatConsoleFields(message, fields); pairs != "" {
+			message += "\t" + pairs
+		}
+
+		if logOutput != os.Stdout {
+			fmt.Fprintln(logOutput, message)
+			return
+		}
+
+		colors := map[int]color.Attribute{Info: color.FgGreen, Warning: color.FgHiYellow, Error: color.FgHiRed}
+		color.Set(colors[messageType])
+		fmt.Println(message)
+		color.Unset()
+	}
+}
+
+// logLevelName returns the level name of messageType
+func logLevelName(messageType int) string {
+	switch messageType {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+
+	return "info"
+}
+
+// sortedLogFields returns the names of fields, those of logFieldOrder first
+func sortedLogFields(fields LogFields) []string {
+	var names []string
+	for _, name := range logFieldOrder {
+		if _, ok := fields[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	var others []string
+	for name := range fields {
+		known := false
+		for _, ordered := range logFieldOrder {
+			known = known || name == ordered
+		}
+		if !known {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+
+	return append(names, others...)
+}
+
+// logFieldValue returns the value written for a field, durations in seconds and secrets redacted
+func logFieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.Seconds()
+	case error:
+		return redactSecrets(v.Error())
+	case string:
+		return redactSecrets(v)
+	}
+
+	return value
+}
+
+func formatJSONEvent(message string, messageType int, fields LogFields) string {
+	var event bytes.Buffer
+
+	writePair := func(name string, value interface{}) {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+
+		key, _ := json.Marshal(name)
+		if event.Len() > 1 {
+			event.WriteByte(',')
+		}
+		event.Write(key)
+		event.WriteByte(':')
+		event.Write(encoded)
+	}
+
+	event.WriteByte('{')
+	writePair("time", time.Now().Format(time.RFC3339Nano))
+	writePair("level", logLevelName(messageType))
+	writePair("msg", message)
+	for _, name := range sortedLogFields(fields) {
+		writePair(name, logFieldValue(fields[name]))
+	}
+	event.WriteByte('}')
+
+	return event.String()
+}
+
+func formatLogfmtEvent(message string, messageType int, fields LogFields) string {
+	pairs := []string{
+		"time=" + time.Now().Format(time.RFC3339Nano),
+		"level=" + logLevelName(messageType),
+		"msg=" + logfmtValue(message),
+	}
+
+	for _, name := range sortedLogFields(fields) {
+		pairs = append(pairs, name+"="+logfmtValue(fmt.Sprint(logFieldValue(fields[name]))))
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// logfmtValue quotes value when it holds spaces, quotes, equal signs or control characters
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"=\\") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+// formatConsoleFields returns the fields of a console message as key=value pairs, durations rounded to the millisecond.
+// The values already written in message are left out.
+func formatConsoleFields(message string, fields LogFields) string {
+	var pairs []string
+	for _, name := range sortedLogFields(fields) {
+		value := fields[name]
+		if duration, ok := value.(time.Duration); ok {
+			value = duration.Round(time.Millisecond)
+		}
+
+		text := redactSecrets(fmt.Sprint(value))
+		if strings.Contains(message, text) {
+			continue
+		}
+		pairs = append(pairs, name+"="+logfmtValue(text))
+	}
+
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatJSONEvent(t *testing.T) {
+	saved := secrets
+	secrets = []string{"s3cret"}
+	defer func() { secrets = saved }()
+
+	tests := []struct {
+		name        string
+		message     string
+		messageType int
+		fields      LogFields
+		want        map[string]interface{}
+		wantOrder   []string
+	}{
+		{
+			name:        "message only",
+			message:     "Processing Database : shop",
+			messageType: Info,
+			want:        map[string]interface{}{"level": "info", "msg": "Processing Database : shop"},
+			wantOrder:   []string{"time", "level", "msg"},
+		},
+		{
+			name:        "fields in order",
+			message:     "dump done",
+			messageType: Warning,
+			fields:      LogFields{"zone": "eu", "table": "orders", "database": "shop", "chunk": 2, "attempt": 3},
+			want:        map[string]interface{}{"level": "warning", "msg": "dump done", "database": "shop", "table": "orders", "chunk": float64(2), "attempt": float64(3), "zone": "eu"},
+			wantOrder:   []string{"time", "level", "msg", "database", "table", "chunk", "attempt", "zone"},
+		},
+		{
+			name:        "duration in seconds and error as text",
+			message:     "dump failed",
+			messageType: Error,
+			fields:      LogFields{"duration": 1500 * time.Millisecond, "error": errors.New(`table "orders" = gone`)},
+			want:        map[string]interface{}{"level": "error", "msg": "dump failed", "duration": 1.5, "error": `table "orders" = gone`},
+			wantOrder:   []string{"time", "level", "msg", "duration", "error"},
+		},
+		{
+			name:        "secrets redacted",
+			message:     "connecting",
+			messageType: Error,
+			fields:      LogFields{"error": errors.New("Access denied for s3cret"), "file": "/tmp/s3cret.cnf"},
+			want:        map[string]interface{}{"level": "error", "msg": "connecting", "error": "Access denied for " + redactedSecret, "file": "/tmp/" + redactedSecret + ".cnf"},
+			wantOrder:   []string{"time", "level", "msg", "file", "error"},
+		},
+		{
+			name:        "value that can not be encoded",
+			message:     "odd",
+			messageType: Info,
+			fields:      LogFields{"callback": func() {}},
+			wantOrder:   []string{"time", "level", "msg", "callback"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := formatJSONEvent(test.message, test.messageType, test.fields)
+
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("event %s is not JSON: %v", line, err)
+			}
+
+			if _, err := time.Parse(time.RFC3339Nano, event["time"].(string)); err != nil {
+				t.Errorf("time %v: %v", event["time"], err)
+			}
+			delete(event, "time")
+
+			for name, want := range test.want {
+				if event[name] != want {
+					t.Errorf("%s = %#v, want %#v", name, event[name], want)
+				}
+			}
+			if len(event) != len(test.wantOrder)-1 {
+				t.Errorf("event %s has %d fields, want %d", line, len(event)+1, len(test.wantOrder))
+			}
+
+			position := -1
+			for _, name := range test.wantOrder {
+				i := strings.Index(line, `"`+name+`":`)
+				if i < position {
+					t.Errorf("field %s out of order in %s", name, line)
+				}
+				position = i
+			}
+		})
+	}
+}
+
+func TestFormatLogfmtEvent(t *testing.T) {
+	saved := secrets
+	secrets = []string{"s3cret"}
+	defer func() { secrets = saved }()
+
+	tests := []struct {
+		name        string
+		message     string
+		messageType int
+		fields      LogFields
+		want        string
+	}{
+		{
+			name:        "message with spaces",
+			message:     "Processing Database : shop",
+			messageType: Info,
+			want:        `level=info msg="Processing Database : shop"`,
+		},
+		{
+			name:        "plain values",
+			message:     "done",
+			messageType: Warning,
+			fields:      LogFields{"table": "orders", "database": "shop", "chunk": 2},
+			want:        `level=warning msg=done database=shop table=orders chunk=2`,
+		},
+		{
+			name:        "value with spaces",
+			message:     "done",
+			messageType: Info,
+			fields:      LogFields{"file": "/backups/my shop/shop_ALL.sql.gz"},
+			want:        `level=info msg=done file="/backups/my shop/shop_ALL.sql.gz"`,
+		},
+		{
+			name:        "value with equal sign",
+			message:     "done",
+			messageType: Info,
+			fields:      LogFields{"where": "id=5"},
+			want:        `level=info msg=done where="id=5"`,
+		},
+		{
+			name:        "value with quotes",
+			message:     "failed",
+			messageType: Error,
+			fields:      LogFields{"error": errors.New(`Couldn't find table: "orders"`)},
+			want:        `level=error msg=failed error="Couldn't find table: \"orders\""`,
+		},
+		{
+			name:        "value with newline and backslash",
+			message:     "failed",
+			messageType: Error,
+			fields:      LogFields{"error": errors.New("line 1\nC:\\tmp")},
+			want:        `level=error msg=failed error="line 1\nC:\\tmp"`,
+		},
+		{
+			name:        "empty value",
+			message:     "done",
+			messageType: Info,
+			fields:      LogFields{"table": ""},
+			want:        `level=info msg=done table=""`,
+		},
+		{
+			name:        "duration in seconds",
+			message:     "done",
+			messageType: Info,
+			fields:      LogFields{"duration": 2500 * time.Millisecond},
+			want:        `level=info msg=done duration=2.5`,
+		},
+		{
+			name:        "secrets redacted",
+			message:     "failed",
+			messageType: Error,
+			fields:      LogFields{"error": errors.New("Access denied for s3cret")},
+			want:        `level=error msg=failed error="Access denied for ` + redactedSecret + `"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := formatLogfmtEvent(test.message, test.messageType, test.fields)
+
+			timestamp := strings.SplitN(line, " ", 2)[0]
+			if _, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(timestamp, "time=")); err != nil || !strings.HasPrefix(timestamp, "time=") {
+				t.Errorf("line %s does not start with the time: %v", line, err)
+			}
+
+			if got := strings.TrimPrefix(line, timestamp+" "); got != test.want {
+				t.Errorf("formatLogfmtEvent = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
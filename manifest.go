@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ManifestFilename is the name of the manifest written in every database backup directory
+const ManifestFilename = "manifest.json"
+
+// Manifest statuses
+const (
+	// ManifestStatusSuccess means every archive of the database was written
+	ManifestStatusSuccess = "success"
+
+	// ManifestStatusFailed means at least one archive of the database is missing or incomplete
+	ManifestStatusFailed = "failed"
+)
+
+// Kinds of archives written by the generate*Backup functions
+const (
+	// KindSchema is the output of generateSchemaBackup
+	KindSchema = "SCHEMA"
+
+	// KindAll is the output of generateSingleFileBackup
+	KindAll = "ALL"
+
+	// KindData is the output of generateSingleFileDataBackup
+	KindData = "DATA"
+
+	// KindTable is one chunk written by generateTableChunkBackup
+	KindTable = "TABLE"
+)
+
+// Manifest model for the description of one database backup directory
+type Manifest struct {
+	Database      string
+	HostName      string
+	ServerVersion string
+	Status        string
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Binlog        BinlogCoordinates
+	Options       Options
+	Files         []ManifestFile
+
+	mu sync.Mutex
+}
+
+// ManifestFile model for one archive listed in a manifest
+type ManifestFile struct {
+	File             string
+	Compression      string
+	Encrypted        bool `json:",omitempty"`
+	Kind             string
+	Table            string `json:",omitempty"`
+	Chunk            int    `json:",omitempty"`
+	Where            string `json:",omitempty"`
+	Rows             *int64 `json:",omitempty"`
+	Size             int64
+	UncompressedSize int64
+	SHA256           string
+}
+
+// NewManifest returns a new Manifest instance for database, started now until Start is called
+func NewManifest(options Options, database string) *Manifest {
+	return &Manifest{
+		Database:  database,
+		HostName:  options.HostName,
+		StartedAt: time.Now(),
+		Options:   redactedOptions(options),
+	}
+}
+
+// Start sets the start of the backup to now, call it when the first dump of the database starts
+func (m *Manifest) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.StartedAt = time.Now()
+}
+
+// redactedOptions returns a copy of options that is safe to write to disk
+func redactedOptions(options Options) Options {
+	options.Password = ""
+
+	// webhook URLs embed their access token
+	if options.NotifyWebhook != "" {
+		options.NotifyWebhook = redactedSecret
+	}
+	if options.NotifySlack != "" {
+		options.NotifySlack = redactedSecret
+	}
+
+	return options
+}
+
+// AddFile records an archive, it is safe to call from concurrent dump jobs
+func (m *Manifest) AddFile(file ManifestFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Files = append(m.Files, file)
+}
+
+// Write finishes the manifest with status and stores it in dir
+func (m *Manifest) Write(dir string, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Status = status
+	m.FinishedAt = time.Now()
+
+	order := map[string]int{KindSchema: 0, KindAll: 1, KindData: 2, KindTable: 3}
+	sort.SliceStable(m.Files, func(i, j int) bool {
+		if order[m.Files[i].Kind] != order[m.Files[j].Kind] {
+			return order[m.Files[i].Kind] < order[m.Files[j].Kind]
+		}
+		if m.Files[i].Table != m.Files[j].Table {
+			return m.Files[i].Table < m.Files[j].Table
+		}
+		return m.Files[i].Chunk < m.Files[j].Chunk
+	})
+
+	content, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// write then rename so a manifest is never seen half written
+	filename := filepath.Join(dir, ManifestFilename)
+	if err := ioutil.WriteFile(filename+".tmp", content, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+// RemoveUnlisted deletes the archives of dir the manifest does not list,
+// left by an earlier run of the same day that was split differently
+func (m *Manifest) RemoveUnlisted(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	listed := map[string]bool{}
+	for _, file := range m.Files {
+		listed[file.File] = true
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() && IsArchive(entry.Name()) && !listed[entry.Name()] {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadManifest reads the manifest of a database backup directory
+func ReadManifest(dir string) (*Manifest, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ManifestFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// readServerInfo fills in the server version and, unless a snapshot already provides them, the binlog coordinates.
+// Without a snapshot the coordinates are read without a lock and only tell roughly where the run started.
+func (m *Manifest) readServerInfo(options Options, snapshot *Snapshot) error {
+	var q queryer
+	if snapshot != nil {
+		session, err := snapshot.Acquire()
+		if err != nil {
+			return err
+		}
+		defer snapshot.Release(session)
+		q = session
+
+		m.Binlog = snapshot.Binlog
+	} else {
+		dsn, err := nativeDataSourceName(options, m.Database)
+		if err != nil {
+			return err
+		}
+
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		q = db
+	}
+
+	if err := q.QueryRow("SELECT VERSION()").Scan(&m.ServerVersion); err != nil {
+		return err
+	}
+
+	if snapshot == nil {
+		binlog, err := GetBinlogCoordinates(q)
+		if err != nil {
+			return err
+		}
+		m.Binlog = binlog
+	}
+
+	return nil
+}
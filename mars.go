@@ -1,15 +1,11 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
@@ -17,9 +13,10 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/fatih/color"
+	"filippo.io/age"
 	_ "github.com/go-sql-driver/mysql"
 )
 
@@ -40,14 +37,16 @@ var timeNow = time.Now()
 type Table struct {
 	TableName string
 	RowCount  int
+	// View is true for a view, whose definition is in the schema backup and which has no data of its own
+	View bool
 }
 
 // Options model for commandline arguments
 type Options struct {
-	HostName          string
-	Bind              string
-	UserName          string
-	Password          string
+	Profile string
+
+	Connection
+	PasswordCommand   string
 	Databases         []string
 	ExcludedDatabases []string
 
@@ -56,7 +55,26 @@ type Options struct {
 	BatchSize                int
 	ForceSplit               bool
 
+	Parallel            int
+	ParallelPerDatabase int
+	Consistent          bool
+
 	AdditionalMySQLDumpArgs string
+	Engine                  string
+	Compression             string
+	CompressionLevel        int
+
+	EncryptionRecipientsFile string
+	EncryptionPassphraseFile string
+	EncryptionRecipients     []age.Recipient `json:"-"`
+
+	Storage    string
+	S3Endpoint string
+	S3Region   string
+	S3Insecure bool
+
+	SFTPKey        string
+	SFTPKnownHosts string
 
 	Verbosity              int
 	MySQLDumpPath          string
@@ -64,48 +82,354 @@ type Options struct {
 	DefaultsProvidedByUser bool
 	ExecutionStartDate     time.Time
 
-	DailyRotation        int
-	WeeklyRotation       int
-	MonthlyRotation      int
+	HourlyRotation  int
+	DailyRotation   int
+	WeeklyRotation  int
+	MonthlyRotation int
+	YearlyRotation  int
+
+	MaxTotalSize int64
+	MinFreeSpace int64
+
+	Schedule     string
+	AllDatabases bool
+
+	MetricsTextfile string
+	MetricsListen   string
+
+	NotifyOn        string
+	NotifyWebhook   string
+	NotifySlack     string
+	NotifySMTP      string
+	NotifyEmailFrom string
+	NotifyEmailTo   string
+
+	RetryAttempts int
+	RetryBackoff  time.Duration
 }
 
 func main() {
-	options := GetOptions()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			os.Exit(Restore(*GetRestoreOptions(os.Args[2:])))
+		case "verify":
+			os.Exit(Verify(*GetVerifyOptions(os.Args[2:])))
+		case "serve":
+			os.Exit(Serve(GetOptions(os.Args[2:])))
+		case "prune":
+			// the report goes to stdout, keep the log apart
+			logConsole, logOutput = os.Stderr, os.Stderr
+			os.Exit(Prune(GetPruneOptions(os.Args[2:])))
+		}
+	}
 
-	for _, db := range options.Databases {
-		printMessage("Processing Database : "+db, options.Verbosity, Info)
-
-		tables := GetTables(options.HostName, options.Bind, options.UserName, options.Password, db, options.Verbosity)
-		totalRowCount := getTotalRowCount(tables)
-
-		if !options.ForceSplit && totalRowCount <= options.DatabaseRowCountTreshold {
-			// options.ForceSplit is false
-			// and if total row count of a database is below defined threshold
-			// then generate one file containing both schema and data
-
-			printMessage(fmt.Sprintf("options.ForceSplit (%t) && totalRowCount (%d) <= options.DatabaseRowCountTreshold (%d)", options.ForceSplit, totalRowCount, options.DatabaseRowCountTreshold), options.Verbosity, Info)
-			generateSingleFileBackup(*options, db)
-		} else if options.ForceSplit && totalRowCount <= options.DatabaseRowCountTreshold {
-			// options.ForceSplit is true
-			// and if total row count of a database is below defined threshold
-			// then generate two files one for schema, one for data
-
-			generateSchemaBackup(*options, db)
-			generateSingleFileDataBackup(*options, db)
-		} else if totalRowCount > options.DatabaseRowCountTreshold {
-			generateSchemaBackup(*options, db)
-
-			for _, table := range tables {
-				generateTableBackup(*options, db, table)
+	allOptions := GetOptions(os.Args[1:])
+
+	textfiles := map[string]bool{}
+	for _, options := range allOptions {
+		if options.MetricsTextfile != "" && !textfiles[options.MetricsTextfile] {
+			textfiles[options.MetricsTextfile] = true
+			if err := LoadMetricsTextfile(options.MetricsTextfile); err != nil {
+				printMessage("error to read metrics of the previous run: "+err.Error(), options.Verbosity, Warning)
+			}
+		}
+	}
+
+	var summaries []*RunSummary
+	for _, options := range allOptions {
+		summaries = append(summaries, runBackup(*options))
+	}
+
+	for textfile := range textfiles {
+		if err := WriteMetricsTextfile(textfile); err != nil {
+			printMessage("error to write metrics: "+err.Error(), allOptions[0].Verbosity, Error)
+		}
+	}
+
+	os.Exit(printRunSummaries(summaries, allOptions[len(allOptions)-1].Verbosity))
+}
+
+// runBackup backs up the databases of one profile and, when at least one of them succeeded, applies its rotation.
+// A database that fails does not stop the others, its errors are returned in the summary.
+func runBackup(options Options) *RunSummary {
+	if options.Profile != "" {
+		printEvent("Processing profile : "+options.Profile, options.Verbosity, Info, LogFields{"profile": options.Profile})
+	}
+
+	var errs []error
+
+	summary := NewRunSummary(options)
+
+	listed := true
+	if options.AllDatabases {
+		dbs, err := GetDatabaseList(options.Connection, options.Verbosity)
+		if err != nil {
+			printMessage("error to list databases: "+err.Error(), options.Verbosity, Error)
+			errs = append(errs, err)
+			listed = false
+		}
+
+		// Databases to not be in the backup
+		options.Databases = difference(dbs, options.ExcludedDatabases)
+	}
+
+	removeStaleStaging(options)
+
+	// without a storage the databases are still dumped and kept in the output-dir,
+	// only the upload, the rotation and the quota of the storage are skipped
+	storage, err := NewStorage(options)
+	if err != nil {
+		printMessage("error to open storage, the backups are kept in "+options.OutputDirectory+": "+err.Error(), options.Verbosity, Error)
+		errs = append(errs, fmt.Errorf("storage: %v", err))
+	}
+
+	if listed {
+		var jobs []BackupJob
+		snapshots := map[string]*snapshotHolder{}
+		for _, db := range options.Databases {
+			dbjobs, snapshot, err := planDatabaseBackup(options, db, summary)
+			if err != nil {
+				printEvent("Processing failed for database : "+db+" : "+err.Error(), options.Verbosity, Error, LogFields{"database": db, "error": err})
+				recordDatabaseFailure(options, db)
+				summary.AddDatabase(DatabaseSummary{Database: db, Status: ManifestStatusFailed})
+				errs = append(errs, fmt.Errorf("%s: %v", db, err))
+				continue
+			}
+
+			jobs = append(jobs, dbjobs...)
+			if snapshot != nil {
+				snapshots[db] = snapshot
 			}
 		}
 
-		printMessage("Processing done for database : "+db, options.Verbosity, Info)
+		if len(snapshots) > 0 {
+			openSnapshots(options, snapshots)
+		}
+
+		errs = append(errs, RunBackupJobs(options, jobs)...)
+	}
+
+	if listed && storage != nil {
+		if options.Storage != "" {
+			errs = append(errs, uploadBackups(options, storage)...)
+		}
+
+		// a failed database keeps the backups it already has, the others are rotated
+		if summary.Succeeded() > 0 {
+			// Backups retentions validation
+			BackupRotation(options, storage)
+		} else {
+			printMessage("No database backed up, skipping the rotation", options.Verbosity, Warning)
+		}
+
+		// the quota also applies after a failed run, whose partial backups take space too
+		if _, failed := applyQuota(options, storage, nil, false); failed > 0 {
+			errs = append(errs, fmt.Errorf("quota: %d backup directories could not be removed", failed))
+		}
+	}
+
+	if options.Profile != "" {
+		for i, err := range errs {
+			errs[i] = fmt.Errorf("%s: %v", options.Profile, err)
+		}
+	}
+
+	summary.Finish(errs)
+	Notify(options, summary)
+
+	return summary
+}
+
+// printRunSummaries prints the outcome of every profile and returns the process exit code:
+// 0 when every database was backed up, 4 when a database, an upload or the storage failed
+func printRunSummaries(summaries []*RunSummary, verbosity int) int {
+	failed := 0
+	for _, summary := range summaries {
+		messageType := Info
+		if summary.Status != ManifestStatusSuccess {
+			messageType = Error
+			failed += len(summary.Errors)
+		}
+
+		for _, line := range strings.Split(strings.TrimRight(summary.Text(), "\n"), "\n") {
+			if line != "" {
+				printEvent(line, verbosity, messageType, LogFields{"profile": summary.Profile})
+			}
+		}
 	}
 
-	// Backups retentions validation
-	BackupRotation(*options)
+	if failed > 0 {
+		printMessage(fmt.Sprintf("Backup failed with %d errors", failed), verbosity, Error)
+		return 4
+	}
 
+	return 0
+}
+
+// planDatabaseBackup returns the jobs that produce the backup files of database db.
+// With options.Consistent the jobs read from the returned snapshot holder, set by openSnapshots before they run, and close it once they are all done.
+// The manifest of the database directory is written, and the outcome added to summary, when the last job finishes.
+func planDatabaseBackup(options Options, db string, summary *RunSummary) ([]BackupJob, *snapshotHolder, error) {
+	printEvent("Processing Database : "+db, options.Verbosity, Info, LogFields{"database": db})
+
+	tables, err := GetTables(options.Connection, db, options.Verbosity)
+	if err != nil {
+		return nil, nil, err
+	}
+	totalRowCount := getTotalRowCount(tables)
+
+	// the manifest is written to the staging directory even when every job fails before creating an archive
+	if err := os.MkdirAll(stagingDirectory(options, db), os.ModePerm); err != nil {
+		return nil, nil, err
+	}
+
+	manifest := NewManifest(options, db)
+
+	// with options.Consistent the snapshot is opened by runBackup, along with the snapshots of the other databases,
+	// and closed once the jobs of the database are done
+	var snapshot *snapshotHolder
+	if options.Consistent {
+		snapshot = newSnapshotHolder(func(opened *Snapshot) {
+			if err := manifest.readServerInfo(options, opened); err != nil {
+				printEvent("error to read server version for the manifest of "+db+": "+err.Error(), options.Verbosity, Warning, LogFields{"database": db})
+			}
+		})
+	} else if err := manifest.readServerInfo(options, nil); err != nil {
+		printEvent("error to read server version and binlog position for the manifest of "+db+": "+err.Error(), options.Verbosity, Warning, LogFields{"database": db})
+	}
+
+	database := newJobGroup(func(failed bool) {
+		snapshot.Close()
+
+		status := ManifestStatusSuccess
+		if failed {
+			status = ManifestStatusFailed
+		}
+
+		// the archives of the run are moved to the database directory only once the manifest is written
+		written := true
+		if err := manifest.Write(stagingDirectory(options, db), status); err != nil {
+			printEvent("error to write manifest of "+db+": "+err.Error(), options.Verbosity, Error, LogFields{"database": db})
+			written = false
+		}
+
+		recordDatabaseMetrics(options, manifest, failed)
+		summary.AddDatabase(manifest.Summary())
+
+		published, err := publishBackup(stagingDirectory(options, db), backupDirectory(options, db), failed || !written)
+		switch {
+		case err != nil:
+			printEvent("error to move the archives of "+db+" to "+backupDirectory(options, db)+": "+err.Error(), options.Verbosity, Error, LogFields{"database": db})
+		case !published:
+			printEvent("Keeping the successful backup of an earlier run of the day of "+db, options.Verbosity, Warning, LogFields{"database": db})
+		case !failed && written:
+			if err := manifest.RemoveUnlisted(backupDirectory(options, db)); err != nil {
+				printEvent("error to remove archives of an earlier run of "+db+": "+err.Error(), options.Verbosity, Warning, LogFields{"database": db})
+			}
+		}
+
+		fields := LogFields{"database": db, "duration": manifest.FinishedAt.Sub(manifest.StartedAt)}
+		if failed {
+			printEvent("Processing failed for database : "+db, options.Verbosity, Error, fields)
+		} else {
+			printEvent("Processing done for database : "+db, options.Verbosity, Info, fields)
+		}
+	})
+
+	// the jobs of every database are planned before the first of them runs,
+	// the backup of the database starts with its first job and not with the time spent waiting for a worker
+	var started sync.Once
+
+	// dump runs generate on the snapshot of the database, if any, and adds the archive of a successful job to the manifest
+	dump := func(generate func(snapshot *Snapshot) (ManifestFile, error)) error {
+		started.Do(manifest.Start)
+
+		opened, err := snapshot.Get()
+		if err != nil {
+			recordDumpFailure(options, db)
+			return err
+		}
+
+		file, err := generate(opened)
+		if err != nil {
+			recordDumpFailure(options, db)
+			return err
+		}
+
+		manifest.AddFile(file)
+		return nil
+	}
+
+	var jobs []BackupJob
+
+	if !options.ForceSplit && totalRowCount <= options.DatabaseRowCountTreshold {
+		// options.ForceSplit is false
+		// and if total row count of a database is below defined threshold
+		// then generate one file containing both schema and data
+
+		printMessage(fmt.Sprintf("options.ForceSplit (%t) && totalRowCount (%d) <= options.DatabaseRowCountTreshold (%d)", options.ForceSplit, totalRowCount, options.DatabaseRowCountTreshold), options.Verbosity, Info)
+		jobs = append(jobs, newBackupJob(db, "single file backup of "+db, func() error {
+			return dump(func(snapshot *Snapshot) (ManifestFile, error) {
+				return generateSingleFileBackup(options, db, snapshot)
+			})
+		}, database))
+	} else if options.ForceSplit && totalRowCount <= options.DatabaseRowCountTreshold {
+		// options.ForceSplit is true
+		// and if total row count of a database is below defined threshold
+		// then generate two files one for schema, one for data
+
+		jobs = append(jobs, newBackupJob(db, "schema backup of "+db, func() error {
+			return dump(func(snapshot *Snapshot) (ManifestFile, error) {
+				return generateSchemaBackup(options, db, snapshot)
+			})
+		}, database))
+		jobs = append(jobs, newBackupJob(db, "single file data backup of "+db, func() error {
+			return dump(func(snapshot *Snapshot) (ManifestFile, error) {
+				return generateSingleFileDataBackup(options, db, snapshot)
+			})
+		}, database))
+	} else if totalRowCount > options.DatabaseRowCountTreshold {
+		jobs = append(jobs, newBackupJob(db, "schema backup of "+db, func() error {
+			return dump(func(snapshot *Snapshot) (ManifestFile, error) {
+				return generateSchemaBackup(options, db, snapshot)
+			})
+		}, database))
+
+		for _, table := range tables {
+			if table.View {
+				continue
+			}
+			jobs = append(jobs, planTableBackup(options, db, table, database, dump)...)
+		}
+	}
+
+	return jobs, snapshot, nil
+}
+
+// openSnapshots opens the snapshots of the databases under a single global read lock, before any dump starts:
+// the lock would otherwise wait for the dumps already running, blocking the writes of the server meanwhile.
+// The databases share at most -parallel sessions. When the opening fails every database gets the error.
+func openSnapshots(options Options, holders map[string]*snapshotHolder) {
+	databases := []string{}
+	for db := range holders {
+		databases = append(databases, db)
+	}
+
+	snapshots, err := OpenSnapshots(options, databases, snapshotSessions(options, len(databases)))
+	if err != nil {
+		printMessage("error to open consistent snapshot: "+err.Error(), options.Verbosity, Error)
+		err = fmt.Errorf("open consistent snapshot: %v", err)
+	} else {
+		for _, opened := range snapshots {
+			printMessage(fmt.Sprintf("Consistent snapshot opened for %d databases. Binlog file : %s\t\tPosition : %s\t\tGTID set : %s", len(snapshots), opened.Binlog.File, opened.Binlog.Position, opened.Binlog.GTIDSet), options.Verbosity, Info)
+			break
+		}
+	}
+
+	for db, holder := range holders {
+		holder.Set(snapshots[db], err)
+	}
 }
 
 // NewTable returns a new Table instance.
@@ -117,65 +441,94 @@ func NewTable(tableName string, rowCount int) *Table {
 }
 
 // GetTables retrives list of tables with rowcounts
-func GetTables(hostname string, bind string, username string, password string, database string, verbosity int) []Table {
-	printMessage("Getting tables for database : "+database, verbosity, Info)
+func GetTables(connection Connection, database string, verbosity int) ([]Table, error) {
+	printEvent("Getting tables for database : "+database, verbosity, Info, LogFields{"database": database})
 
-	db, err := sql.Open("mysql", username+":"+password+"@tcp("+hostname+":"+bind+")/"+database)
-
-	checkErr(err)
+	dsn, err := connection.DataSourceName(database, nil)
+	if err != nil {
+		return nil, err
+	}
 
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT table_name as TableName, table_rows as RowCount FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = '" + database + "'")
-	checkErr(err)
+	rows, err := db.Query("SELECT table_name as TableName, table_rows as RowCount, table_type as TableType FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = ?", database)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %v", err)
+	}
+	defer rows.Close()
 
 	var result []Table
 
 	for rows.Next() {
-		var tableName string
-		var rowCount int
+		var tableName, tableType string
+		// views have no row count
+		var rowCount sql.NullInt64
 
-		err = rows.Scan(&tableName, &rowCount)
-		checkErr(err)
+		if err := rows.Scan(&tableName, &rowCount, &tableType); err != nil {
+			return nil, fmt.Errorf("list tables: %v", err)
+		}
 
-		result = append(result, *NewTable(tableName, rowCount))
+		table := NewTable(tableName, int(rowCount.Int64))
+		table.View = tableType == "VIEW"
+		result = append(result, *table)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list tables: %v", err)
 	}
 
-	printMessage(strconv.Itoa(len(result))+" tables retrived : "+database, verbosity, Info)
+	printEvent(strconv.Itoa(len(result))+" tables retrived : "+database, verbosity, Info, LogFields{"database": database})
 
-	return result
+	return result, nil
 }
 
 // GetDatabaseList retrives list of databases on mysql
-func GetDatabaseList(hostname string, bind string, username string, password string, verbosity int) []string {
-	printMessage("Getting databases : "+hostname, verbosity, Info)
+func GetDatabaseList(connection Connection, verbosity int) ([]string, error) {
+	printMessage("Getting databases : "+connection.HostName, verbosity, Info)
 
-	db, err := sql.Open("mysql", username+":"+password+"@tcp("+hostname+":"+bind+")/mysql")
-	checkErr(err)
+	dsn, err := connection.DataSourceName("mysql", nil)
+	if err != nil {
+		return nil, err
+	}
 
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
 	defer db.Close()
 
 	rows, err := db.Query("SHOW DATABASES")
-	checkErr(err)
+	if err != nil {
+		return nil, fmt.Errorf("list databases: %v", err)
+	}
+	defer rows.Close()
 
 	var result []string
 
 	for rows.Next() {
 		var databaseName string
 
-		err = rows.Scan(&databaseName)
-		checkErr(err)
+		if err := rows.Scan(&databaseName); err != nil {
+			return nil, fmt.Errorf("list databases: %v", err)
+		}
 
 		result = append(result, databaseName)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list databases: %v", err)
+	}
 
-	printMessage(strconv.Itoa(len(result))+" databases retrived : "+hostname, verbosity, Info)
+	printMessage(strconv.Itoa(len(result))+" databases retrived : "+connection.HostName, verbosity, Info)
 
-	return result
+	return result, nil
 }
 
-// NewOptions returns a new Options instance.
-func NewOptions(hostname string, bind string, username string, password string, databases string, excludeddatabases string, databasetreshold int, tablethreshold int, batchsize int, forcesplit bool, additionals string, verbosity int, mysqldumppath string, outputDirectory string, defaultsProvidedByUser bool, dailyrotation int, weeklyrotation int, monthlyrotation int) *Options {
+// NewOptions returns a new Options instance from the options bound to the flags
+// and the comma separated lists of databases and excluded databases
+func NewOptions(flags Options, databases string, excludeddatabases string) *Options {
 
 	databases = strings.Replace(databases, " ", "", -1)
 	databases = strings.Replace(databases, " , ", ",", -1)
@@ -185,46 +538,30 @@ func NewOptions(hostname string, bind string, username string, password string,
 	dbs = removeDuplicates(dbs)
 
 	excludeddbs := []string{}
+	alldatabases := databases == "--all-databases"
 
-	if databases == "--all-databases" {
+	if alldatabases {
 
 		excludeddatabases = excludeddatabases + ",information_schema,performance_schema"
 
-		dbslist := GetDatabaseList(hostname, bind, username, password, verbosity)
-		databases = strings.Join(dbslist, ",")
-
 		excludeddatabases = strings.Replace(excludeddatabases, " ", "", -1)
 		excludeddatabases = strings.Replace(excludeddatabases, " , ", ",", -1)
 		excludeddatabases = strings.Replace(excludeddatabases, ", ", ",", -1)
 		excludeddatabases = strings.Replace(excludeddatabases, " ,", ",", -1)
-		excludeddbs := strings.Split(excludeddatabases, ",")
+		excludeddbs = strings.Split(excludeddatabases, ",")
 		excludeddbs = removeDuplicates(excludeddbs)
 
-		// Databases to not be in the backup
-		dbs = difference(dbslist, excludeddbs)
-	}
-
-	return &Options{
-		HostName:                 hostname,
-		Bind:                     bind,
-		UserName:                 username,
-		Password:                 password,
-		Databases:                dbs,
-		ExcludedDatabases:        excludeddbs,
-		DatabaseRowCountTreshold: databasetreshold,
-		TableRowCountTreshold:    tablethreshold,
-		BatchSize:                batchsize,
-		ForceSplit:               forcesplit,
-		AdditionalMySQLDumpArgs:  additionals,
-		Verbosity:                verbosity,
-		MySQLDumpPath:            mysqldumppath,
-		OutputDirectory:          outputDirectory,
-		DefaultsProvidedByUser:   defaultsProvidedByUser,
-		ExecutionStartDate:       timeNow,
-		DailyRotation:            dailyrotation,
-		WeeklyRotation:           weeklyrotation,
-		MonthlyRotation:          monthlyrotation,
+		// the databases are listed when the backup runs, see runBackup
+		dbs = nil
 	}
+
+	options := flags
+	options.Databases = dbs
+	options.ExcludedDatabases = excludeddbs
+	options.AllDatabases = alldatabases
+	options.ExecutionStartDate = timeNow
+
+	return &options
 }
 
 func removeDuplicates(elements []string) []string {
@@ -261,282 +598,340 @@ func difference(a, b []string) []string {
 	return ab
 }
 
-func generateTableBackup(options Options, db string, table Table) {
-	printMessage("Generating table backup. Database : "+db+"\t\tTableName : "+table.TableName+"\t\tRowCount : "+strconv.Itoa(table.RowCount), options.Verbosity, Info)
-
-	index := 1
-	for counter := 0; counter <= table.RowCount; counter += options.BatchSize {
+// planTableBackup returns one job per chunk of table, each dumping about options.BatchSize rows
+func planTableBackup(options Options, db string, table Table, database *jobGroup, dump func(generate func(snapshot *Snapshot) (ManifestFile, error)) error) []BackupJob {
+	start := time.Now()
+	printEvent("Generating table backup. Database : "+db+"\t\tTableName : "+table.TableName+"\t\tRowCount : "+strconv.Itoa(table.RowCount), options.Verbosity, Info, LogFields{"database": db, "table": table.TableName, "rows": table.RowCount})
 
-		var args []string
-		args = append(args, fmt.Sprintf("-h%s", options.HostName))
-		args = append(args, fmt.Sprintf("-u%s", options.UserName))
-		args = append(args, fmt.Sprintf("-p%s", options.Password))
+	group := newJobGroup(func(failed bool) {
+		if !failed {
+			printEvent("Table backup successfull. Database : "+db+"\t\tTableName : "+table.TableName, options.Verbosity, Info, LogFields{"database": db, "table": table.TableName, "duration": time.Since(start)})
+		}
+	})
 
-		args = append(args, "--no-create-db")
-		args = append(args, "--skip-triggers")
-		args = append(args, "--no-create-info")
+	var jobs []BackupJob
 
-		if options.AdditionalMySQLDumpArgs != "" {
-			args = append(args, strings.Split(options.AdditionalMySQLDumpArgs, " ")...)
-		}
+	for _, chunk := range GetTableChunks(options, db, table) {
+		chunk := chunk
+		jobs = append(jobs, newBackupJob(db, fmt.Sprintf("table backup of %s.%s chunk %d", db, table.TableName, chunk.Index), func() error {
+			return dump(func(snapshot *Snapshot) (ManifestFile, error) {
+				return generateTableChunkBackup(options, db, table, chunk, snapshot)
+			})
+		}, database, group))
+	}
 
-		timestamp := strings.Replace(strings.Replace(options.ExecutionStartDate.Format("2006-01-02"), "-", "", -1), ":", "", -1)
-		filename := path.Join(options.OutputDirectory, "daily", timeNow.Format("2006-01-02"), db+"-"+options.ExecutionStartDate.Format("2006-01-02"), fmt.Sprintf("%s_%s%d_%s.sql", db, table.TableName, index, timestamp))
-		_ = os.Mkdir(path.Dir(filename), os.ModePerm)
+	return jobs
+}
 
-		args = append(args, fmt.Sprintf("-r%s", filename))
+// generateTableChunkBackup dumps the rows of table selected by chunk into chunk file chunk.Index
+func generateTableChunkBackup(options Options, db string, table Table, chunk Chunk, snapshot *Snapshot) (ManifestFile, error) {
+	request := DumpRequest{
+		Database:     db,
+		Tables:       []string{table.TableName},
+		Where:        chunk.Where,
+		NoCreateDB:   true,
+		NoCreateInfo: true,
+		SkipTriggers: true,
+		Snapshot:     snapshot,
+	}
 
-		args = append(args, fmt.Sprintf("--where=1=1 LIMIT %d, %d", counter, options.BatchSize))
+	return archiveDump(options, request, backupFilename(options, db, fmt.Sprintf("%s%d", table.TableName, chunk.Index)), ManifestFile{Kind: KindTable, Table: table.TableName, Chunk: chunk.Index, Where: chunk.Where})
+}
 
-		args = append(args, db)
-		args = append(args, table.TableName)
+func generateSchemaBackup(options Options, db string, snapshot *Snapshot) (ManifestFile, error) {
+	printEvent("Generating schema backup : "+db, options.Verbosity, Info, LogFields{"database": db})
 
-		cmd := exec.Command(options.MySQLDumpPath, args...)
-		cmdOut, _ := cmd.StdoutPipe()
-		cmdErr, _ := cmd.StderrPipe()
+	request := DumpRequest{
+		Database: db,
+		NoData:   true,
+		Snapshot: snapshot,
+	}
 
-		printMessage("mysqldump is being executed with parameters : "+strings.Join(cmd.Args, " "), options.Verbosity, Info)
-		cmd.Start()
+	file, err := archiveDump(options, request, backupFilename(options, db, KindSchema), ManifestFile{Kind: KindSchema})
+	if err != nil {
+		return file, err
+	}
 
-		output, _ := ioutil.ReadAll(cmdOut)
-		err, _ := ioutil.ReadAll(cmdErr)
-		cmd.Wait()
+	printEvent("Schema backup successfull : "+db, options.Verbosity, Info, LogFields{"database": db, "file": file.File})
 
-		printMessage("mysqldump output is : "+string(output), options.Verbosity, Info)
+	return file, nil
+}
 
-		if string(err) != "" {
-			printMessage("mysqldump error is: "+string(err), options.Verbosity, Error)
-			os.Exit(4)
-		}
+func generateSingleFileDataBackup(options Options, db string, snapshot *Snapshot) (ManifestFile, error) {
+	printEvent("Generating single file data backup : "+db, options.Verbosity, Info, LogFields{"database": db})
 
-		// Compressing
-		printMessage("Compressing table file : "+filename, options.Verbosity, Info)
+	request := DumpRequest{
+		Database:     db,
+		NoCreateDB:   true,
+		NoCreateInfo: true,
+		SkipTriggers: true,
+		Snapshot:     snapshot,
+	}
 
-		// set up the output file
-		file, errcreate := os.Create(filename + ".tar.gz")
+	file, err := archiveDump(options, request, backupFilename(options, db, KindData), ManifestFile{Kind: KindData})
+	if err != nil {
+		return file, err
+	}
 
-		if errcreate != nil {
-			printMessage("error to create a compressed file: "+filename, options.Verbosity, Error)
-			os.Exit(4)
-		}
+	printEvent("Single file data backup successfull : "+db, options.Verbosity, Info, LogFields{"database": db, "file": file.File})
 
-		defer file.Close()
-		// set up the gzip writer
-		gw := gzip.NewWriter(file)
-		defer gw.Close()
-		tw := tar.NewWriter(gw)
-		defer tw.Close()
+	return file, nil
+}
 
-		if errcompress := Compress(tw, filename); errcompress != nil {
-			printMessage("error to compress file: "+filename, options.Verbosity, Error)
-			os.Exit(4)
-		}
+func generateSingleFileBackup(options Options, db string, snapshot *Snapshot) (ManifestFile, error) {
+	printEvent("Generating single file backup : "+db, options.Verbosity, Info, LogFields{"database": db})
 
-		index++
+	request := DumpRequest{
+		Database: db,
+		Snapshot: snapshot,
 	}
 
-	printMessage("Table backup successfull. Database : "+db+"\t\tTableName : "+table.TableName, options.Verbosity, Info)
-}
-
-func generateSchemaBackup(options Options, db string) {
-	printMessage("Generating schema backup : "+db, options.Verbosity, Info)
+	file, err := archiveDump(options, request, backupFilename(options, db, KindAll), ManifestFile{Kind: KindAll})
+	if err != nil {
+		return file, err
+	}
 
-	var args []string
-	args = append(args, fmt.Sprintf("-h%s", options.HostName))
-	args = append(args, fmt.Sprintf("-u%s", options.UserName))
-	args = append(args, fmt.Sprintf("-p%s", options.Password))
+	printEvent("Single file backup successfull : "+db, options.Verbosity, Info, LogFields{"database": db, "file": file.File})
 
-	args = append(args, "--no-data")
+	return file, nil
+}
 
-	if options.AdditionalMySQLDumpArgs != "" {
-		args = append(args, strings.Split(options.AdditionalMySQLDumpArgs, " ")...)
+// archiveDump streams the dump described by request into the archive filename
+// and completes file with the description of the archive
+func archiveDump(options Options, request DumpRequest, filename string, file ManifestFile) (ManifestFile, error) {
+	start := time.Now()
+	fields := LogFields{"database": request.Database, "file": filename}
+	if file.Table != "" {
+		fields["table"] = file.Table
+	}
+	if file.Kind == KindTable {
+		fields["chunk"] = file.Chunk
 	}
 
-	timestamp := strings.Replace(strings.Replace(options.ExecutionStartDate.Format("2006-01-02"), "-", "", -1), ":", "", -1)
-	filename := path.Join(options.OutputDirectory, "daily", timeNow.Format("2006-01-02"), db+"-"+options.ExecutionStartDate.Format("2006-01-02"), fmt.Sprintf("%s_%s_%s.sql", db, "SCHEMA", timestamp))
-	_ = os.Mkdir(path.Dir(filename), os.ModePerm)
+	printEvent("Compressing dump into : "+filename, options.Verbosity, Info, fields)
 
-	args = append(args, fmt.Sprintf("-r%s", filename))
+	// failure prints the error of an attempt
+	failure := func(message string, err error) {
+		attemptFields := LogFields{"error": err, "duration": time.Since(start)}
+		for name, value := range fields {
+			attemptFields[name] = value
+		}
+		printEvent(message, options.Verbosity, Error, attemptFields)
+	}
 
-	args = append(args, db)
+	retryOptions := options
+	if request.Snapshot != nil {
+		// a new session can not rejoin the consistent snapshot of the database
+		retryOptions.RetryAttempts = 1
+	}
 
-	printMessage("mysqldump is being executed with parameters : "+strings.Join(args, " "), options.Verbosity, Info)
+	var archive *ArchiveWriter
+	var rows int64
 
-	cmd := exec.Command(options.MySQLDumpPath, args...)
-	cmdOut, _ := cmd.StdoutPipe()
-	cmdErr, _ := cmd.StderrPipe()
+	// the partial archive of a failed attempt is removed before the next one, or when giving up
+	err := withRetry(retryOptions, "dump into "+filename, fields, func() { os.Remove(filename) }, func() error {
+		var err error
 
-	cmd.Start()
+		archive, err = CreateArchive(filename, options.Compression, options.CompressionLevel, options.EncryptionRecipients)
+		if err != nil {
+			failure("error to create a compressed file: "+filename, err)
+			return err
+		}
 
-	output, _ := ioutil.ReadAll(cmdOut)
-	err, _ := ioutil.ReadAll(cmdErr)
-	cmd.Wait()
+		rows, err = runDump(options, request, archive)
+		if err != nil {
+			archive.Close()
+			failure("dump error is: "+err.Error(), err)
+			return err
+		}
 
-	printMessage("mysqldump output is : "+string(output), options.Verbosity, Info)
+		if err := archive.Close(); err != nil {
+			failure("error to compress file: "+filename, err)
+			return err
+		}
 
-	if string(err) != "" {
-		printMessage("mysqldump error is: "+string(err), options.Verbosity, Error)
-		os.Exit(4)
+		return nil
+	})
+	if err != nil {
+		return file, err
 	}
 
-	// Compressing
-	printMessage("Compressing table file : "+filename, options.Verbosity, Info)
-
-	// set up the output file
-	file, errcreate := os.Create(filename + ".tar.gz")
-
-	if errcreate != nil {
-		printMessage("error to create a compressed file: "+filename, options.Verbosity, Error)
-		os.Exit(4)
+	if rows >= 0 {
+		file.Rows = &rows
 	}
 
-	defer file.Close()
-	// set up the gzip writer
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	file.File = path.Base(filename)
+	file.Compression = options.Compression
+	file.Encrypted = len(options.EncryptionRecipients) > 0
+	file.Size = archive.Size()
+	file.UncompressedSize = archive.UncompressedSize()
+	file.SHA256 = archive.SHA256()
 
-	if errcompress := Compress(tw, filename); errcompress != nil {
-		printMessage("error to compress file: "+filename, options.Verbosity, Error)
-		os.Exit(4)
+	fields["duration"], fields["size"] = time.Since(start), file.Size
+	if file.Rows != nil {
+		fields["rows"] = *file.Rows
 	}
+	printEvent("Archive written : "+filename, options.Verbosity, Info, fields)
 
-	printMessage("Schema backup successfull : "+db, options.Verbosity, Info)
+	return file, nil
 }
 
-func generateSingleFileDataBackup(options Options, db string) {
-	printMessage("Generating single file data backup : "+db, options.Verbosity, Info)
-
-	var args []string
-	args = append(args, fmt.Sprintf("-h%s", options.HostName))
-	args = append(args, fmt.Sprintf("-u%s", options.UserName))
-	args = append(args, fmt.Sprintf("-p%s", options.Password))
-
-	args = append(args, "--no-create-db")
-	args = append(args, "--skip-triggers")
-	args = append(args, "--no-create-info")
-
-	if options.AdditionalMySQLDumpArgs != "" {
-		args = append(args, strings.Split(options.AdditionalMySQLDumpArgs, " ")...)
-	}
+// backupDirectory returns the directory holding the backup files of database db for this run
+func backupDirectory(options Options, db string) string {
+	return path.Join(options.OutputDirectory, "daily", options.ExecutionStartDate.Format("2006-01-02"), db+"-"+options.ExecutionStartDate.Format("2006-01-02"))
+}
 
-	timestamp := strings.Replace(strings.Replace(options.ExecutionStartDate.Format("2006-01-02"), "-", "", -1), ":", "", -1)
-	filename := path.Join(options.OutputDirectory, "daily", timeNow.Format("2006-01-02"), db+"-"+options.ExecutionStartDate.Format("2006-01-02"), fmt.Sprintf("%s_%s_%s.sql", db, "DATA", timestamp))
-	_ = os.Mkdir(path.Dir(filename), os.ModePerm)
+// stagingDirectoryName is the directory of the output directory holding the archives of the runs in progress
+const stagingDirectoryName = ".partial"
 
-	args = append(args, fmt.Sprintf("-r%s", filename))
+// stagingDirectory returns the directory the archives of database db are written to during this run,
+// they are moved to backupDirectory by publishBackup once the database is done
+func stagingDirectory(options Options, db string) string {
+	return path.Join(options.OutputDirectory, stagingDirectoryName, fmt.Sprintf("%s-%d", path.Base(backupDirectory(options, db)), options.ExecutionStartDate.UnixNano()))
+}
 
-	args = append(args, db)
+// staleStagingAge is the time after which a staging directory that is no longer written to is taken as left by an interrupted run
+const staleStagingAge = 24 * time.Hour
 
-	printMessage("mysqldump is being executed with parameters : "+strings.Join(args, " "), options.Verbosity, Info)
+// removeStaleStaging removes the staging directories of the output directory whose files were not written
+// for staleStagingAge, left by an interrupted run. The staging directories of the runs in progress are kept.
+func removeStaleStaging(options Options) {
+	root := path.Join(options.OutputDirectory, stagingDirectoryName)
 
-	cmd := exec.Command(options.MySQLDumpPath, args...)
-	cmdOut, _ := cmd.StdoutPipe()
-	cmdErr, _ := cmd.StderrPipe()
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
 
-	cmd.Start()
+	for _, entry := range entries {
+		staging := filepath.Join(root, entry.Name())
 
-	output, _ := ioutil.ReadAll(cmdOut)
-	err, _ := ioutil.ReadAll(cmdErr)
-	cmd.Wait()
+		modified := entry.ModTime()
+		filepath.Walk(staging, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.ModTime().After(modified) {
+				modified = info.ModTime()
+			}
+			return nil
+		})
 
-	printMessage("mysqldump output is : "+string(output), options.Verbosity, Info)
+		if time.Since(modified) < staleStagingAge {
+			continue
+		}
 
-	if string(err) != "" {
-		printMessage("mysqldump error is: "+string(err), options.Verbosity, Error)
-		os.Exit(4)
+		printMessage("Removing "+staging+", left by an interrupted run", options.Verbosity, Warning)
+		if err := os.RemoveAll(staging); err != nil {
+			printMessage("error to remove "+staging+": "+err.Error(), options.Verbosity, Warning)
+		}
 	}
+}
 
-	// Compressing
-	printMessage("Compressing table file : "+filename, options.Verbosity, Info)
-
-	// set up the output file
-	file, errcreate := os.Create(filename + ".tar.gz")
+// publishBackup moves the archives and the manifest written to staging by a run into dir, replacing the files
+// of the same name of an earlier run of the day, and removes staging. The manifest is moved last.
+// A failed run does not replace the successful backup of an earlier run: its archives are then discarded
+// and published is false.
+func publishBackup(staging string, dir string, failed bool) (published bool, err error) {
+	defer os.RemoveAll(staging)
 
-	if errcreate != nil {
-		printMessage("error to create a compressed file: "+filename, options.Verbosity, Error)
-		os.Exit(4)
+	if failed {
+		if earlier, err := ReadManifest(dir); err == nil && earlier.Status == ManifestStatusSuccess {
+			return false, nil
+		}
 	}
 
-	defer file.Close()
-	// set up the gzip writer
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
-
-	if errcompress := Compress(tw, filename); errcompress != nil {
-		printMessage("error to compress file: "+filename, options.Verbosity, Error)
-		os.Exit(4)
+	entries, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return false, err
 	}
 
-	printMessage("Single file data backup successfull : "+db, options.Verbosity, Info)
-}
-
-func generateSingleFileBackup(options Options, db string) {
-	printMessage("Generating single file backup : "+db, options.Verbosity, Info)
-
-	var args []string
-	args = append(args, fmt.Sprintf("-h%s", options.HostName))
-	args = append(args, fmt.Sprintf("-u%s", options.UserName))
-	args = append(args, fmt.Sprintf("-p%s", options.Password))
-
-	if options.AdditionalMySQLDumpArgs != "" {
-		args = append(args, strings.Split(options.AdditionalMySQLDumpArgs, " ")...)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return false, err
 	}
 
-	timestamp := strings.Replace(strings.Replace(options.ExecutionStartDate.Format("2006-01-02"), "-", "", -1), ":", "", -1)
-	filename := path.Join(options.OutputDirectory, "daily", timeNow.Format("2006-01-02"), db+"-"+options.ExecutionStartDate.Format("2006-01-02"), fmt.Sprintf("%s_%s_%s.sql", db, "ALL", timestamp))
-	_ = os.Mkdir(path.Dir(filename), os.ModePerm)
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && entry.Name() != ManifestFilename {
+			names = append(names, entry.Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, ManifestFilename)); err == nil {
+		names = append(names, ManifestFilename)
+	}
 
-	args = append(args, fmt.Sprintf("-r%s", filename))
+	// an archive of the earlier run may be hardlinked to the weekly or monthly backups, rename replaces it without changing them
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(dir, name)); err != nil {
+			return false, err
+		}
+	}
 
-	args = append(args, db)
+	return true, nil
+}
 
-	printMessage("mysqldump is being executed with parameters : "+strings.Join(args, " "), options.Verbosity, Info)
+// uploadBackups puts the backup directories of this run to storage and removes their local copy once uploaded
+func uploadBackups(options Options, storage Storage) []error {
+	var errs []error
 
-	cmd := exec.Command(options.MySQLDumpPath, args...)
-	cmdOut, _ := cmd.StdoutPipe()
-	cmdErr, _ := cmd.StderrPipe()
+	for _, db := range options.Databases {
+		dir := backupDirectory(options, db)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
 
-	cmd.Start()
+		rel, err := filepath.Rel(options.OutputDirectory, dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", db, err))
+			continue
+		}
 
-	output, _ := ioutil.ReadAll(cmdOut)
-	err, _ := ioutil.ReadAll(cmdErr)
-	cmd.Wait()
+		// the backup of an earlier successful run of the day, already uploaded, is not replaced by a failed one
+		if manifest, err := ReadManifest(dir); err == nil && manifest.Status != ManifestStatusSuccess {
+			status, err := storageManifestStatus(storage, filepath.ToSlash(rel))
+			if err != nil {
+				printEvent("Upload failed for database : "+db+" : "+err.Error(), options.Verbosity, Error, LogFields{"database": db, "error": err})
+				errs = append(errs, fmt.Errorf("%s: upload: %v", db, err))
+				continue
+			}
 
-	printMessage("mysqldump output is : "+string(output), options.Verbosity, Info)
+			if status == ManifestStatusSuccess {
+				printEvent("Keeping the successful backup of an earlier run of the day of "+db+" in "+storage.String(), options.Verbosity, Warning, LogFields{"database": db})
+				if err := os.RemoveAll(dir); err != nil {
+					printMessage("error to remove local copy "+dir+": "+err.Error(), options.Verbosity, Warning)
+				}
+				continue
+			}
+		}
 
-	if string(err) != "" {
-		printMessage("mysqldump error is: "+string(err), options.Verbosity, Error)
-		os.Exit(4)
-	}
+		printEvent("Uploading "+dir+" to "+storage.String(), options.Verbosity, Info, LogFields{"database": db, "file": dir})
 
-	// Compressing
-	printMessage("Compressing table file : "+filename, options.Verbosity, Info)
+		if err := UploadDirectory(storage, dir, filepath.ToSlash(rel)); err != nil {
+			printEvent("Upload failed for database : "+db+" : "+err.Error(), options.Verbosity, Error, LogFields{"database": db, "error": err})
+			errs = append(errs, fmt.Errorf("%s: upload: %v", db, err))
+			continue
+		}
 
-	// set up the output file
-	file, errcreate := os.Create(filename + ".tar.gz")
+		if err := os.RemoveAll(dir); err != nil {
+			printMessage("error to remove local copy "+dir+": "+err.Error(), options.Verbosity, Warning)
+		}
 
-	if errcreate != nil {
-		printMessage("error to create a compressed file: "+filename, options.Verbosity, Error)
-		os.Exit(4)
+		printEvent("Upload done for database : "+db, options.Verbosity, Info, LogFields{"database": db})
 	}
 
-	defer file.Close()
-	// set up the gzip writer
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	return errs
+}
 
-	if errcompress := Compress(tw, filename); errcompress != nil {
-		printMessage("error to compress file: "+filename, options.Verbosity, Error)
-		os.Exit(4)
+// backupFilename returns the archive path of a database backup part (SCHEMA, DATA, ALL or {TABLENAME}{INDEX})
+// and makes sure its directory exists
+func backupFilename(options Options, db string, part string) string {
+	timestamp := strings.Replace(strings.Replace(options.ExecutionStartDate.Format("2006-01-02"), "-", "", -1), ":", "", -1)
+	codec, _ := GetCodec(options.Compression)
+	extension := codec.Extension
+	if len(options.EncryptionRecipients) > 0 {
+		extension += EncryptedExtension
 	}
+	filename := path.Join(stagingDirectory(options, db), fmt.Sprintf("%s_%s_%s%s", db, part, timestamp, extension))
+	_ = os.MkdirAll(path.Dir(filename), os.ModePerm)
 
-	printMessage("Single file backup successfull : "+db, options.Verbosity, Info)
+	return filename
 }
 
 func getTotalRowCount(tables []Table) int {
@@ -548,429 +943,300 @@ func getTotalRowCount(tables []Table) int {
 	return result
 }
 
-// Compress compresses files into tar.gz file
-func Compress(tw *tar.Writer, path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	if stat, err := file.Stat(); err == nil {
-		// now lets create the header as needed for this file within the tarball
-		header := new(tar.Header)
-		header.Name = path
-		header.Size = stat.Size()
-		header.Mode = int64(stat.Mode())
-		header.ModTime = stat.ModTime()
-		// write the header to the tarball archive
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
-		// copy the file data to the tarball
-		if _, err := io.Copy(tw, file); err != nil {
-			return err
-		}
+// GetOptions creates Options type from Commandline arguments, one for each profile of the -config file
+func GetOptions(arguments []string) []*Options {
+	return parseOptions(arguments, false)
+}
 
-		// Removing the original file after zipping it
-		err = os.Remove(path)
+// parseOptions parses the flags of a backup run, or with prune of mars prune: the options of the dump engine
+// and of the mysql connection are then not checked, and the backup directories are not created
+func parseOptions(arguments []string, prune bool) []*Options {
 
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-	}
-	return nil
-}
+	// the options are bound to the flags, the values needing parsing are kept apart
+	var flags Options
+	flag.StringVar(&flags.HostName, "hostname", "localhost", "Hostname of the mysql server to connect to")
 
-// ListDirs give a Array of folders in a given path
-func ListDirs(rootpath string) []string {
+	flag.StringVar(&flags.Bind, "bind", "3306", "Port of the mysql server to connect to")
 
-	list := make([]string, 0, 10)
+	flag.StringVar(&flags.UserName, "username", "root", "username of the mysql server to connect to")
 
-	err := filepath.Walk(rootpath, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			list = append(list, path)
-		}
+	flag.StringVar(&flags.Password, "password", "", "password of the mysql server to connect to. Visible to other users in ps, prefer the "+PasswordEnv+" environment variable or -password-command")
 
-		return nil
-	})
-	if err != nil {
-		fmt.Printf("walk error [%v]\n", err)
-	}
-	return list
-}
+	flag.StringVar(&flags.PasswordCommand, "password-command", "", "Shell command printing the password of the mysql server, e.g. a secret manager client")
 
-// BackupRotation execute a rotation of file, daily,weekly and monthly
-func BackupRotation(options Options) {
-	//month
-	if options.MonthlyRotation > 0 {
-		monthly := ListDirs(options.OutputDirectory + "/monthly")
-		if len(monthly) == 1 {
-			CopyDir(options.OutputDirectory+"/daily/"+timeNow.Format("2006-01-02"), options.OutputDirectory+"/monthly/"+timeNow.Format("2006-01-02"))
-		} else {
-			newestFile := 0
-
-			for _, p := range monthly {
-				if path.Base(p) != "monthly" {
-					file, err := os.Stat(path.Dir(p))
-					if err != nil {
-						fmt.Println(err)
-					}
-					diff := timeNow.Sub(file.ModTime())
-					days := int(diff.Hours() / 24)
-					if (len(monthly) - 1) < options.MonthlyRotation {
-						if newestFile < days {
-							newestFile = days
-						}
-					} else {
-						// removing old backups
-						if days > options.MonthlyRotation*30 {
-							err = os.Remove(path.Dir(p))
-							if err != nil {
-								fmt.Println(err)
-							}
-						}
-					}
-				}
-			}
-			if newestFile >= 30 {
-				CopyDir(options.OutputDirectory+"/daily/"+timeNow.Format("2006-01-02"), options.OutputDirectory+"/monthly/"+timeNow.Format("2006-01-02"))
-			}
-		}
-	}
+	defineConnectionFlags(flag.CommandLine, &flags.Connection)
 
-	//weekly
-	if options.MonthlyRotation > 0 {
-		weekly := ListDirs(options.OutputDirectory + "/weekly")
-		if len(weekly) == 1 {
-			CopyDir(options.OutputDirectory+"/daily/"+timeNow.Format("2006-01-02"), options.OutputDirectory+"/weekly/"+timeNow.Format("2006-01-02"))
-		} else {
-			newestFile := 0
-
-			for _, p := range weekly {
-				if path.Base(p) != "weekly" {
-					file, err := os.Stat(path.Dir(p))
-					if err != nil {
-						fmt.Println(err)
-					}
-					diff := timeNow.Sub(file.ModTime())
-					days := int(diff.Hours() / 24)
-					if (len(weekly) - 1) < options.WeeklyRotation {
-						if newestFile < days {
-							newestFile = days
-						}
-					} else {
-						// removing old backups
-						if days > options.WeeklyRotation*7 {
-							err = os.Remove(path.Dir(p))
-							if err != nil {
-								fmt.Println(err)
-							}
-						}
-					}
-				}
-			}
-			if newestFile >= 7 {
-				CopyDir(options.OutputDirectory+"/daily/"+timeNow.Format("2006-01-02"), options.OutputDirectory+"/weekly/"+timeNow.Format("2006-01-02"))
-			}
-		}
-	}
+	var databases string
+	flag.StringVar(&databases, "databases", "--all-databases", "List of databases as comma seperated values to dump. OBS: If not specified, --all-databases is the default")
 
-	//daily
-	if options.DailyRotation > 0 {
-		daily := ListDirs(options.OutputDirectory + "/daily")
-		newestFile := 0
-		for _, p := range daily {
-			if path.Base(p) != "daily" {
-				file, err := os.Stat(path.Dir(p))
-				if err != nil {
-					fmt.Println(err)
-				}
-				diff := timeNow.Sub(file.ModTime())
-				days := int(diff.Hours() / 24)
-
-				if (len(daily) - 1) < options.DailyRotation {
-					if newestFile < days {
-						newestFile = days
-					}
-				} else {
-					// removing old backups
-					if days > options.DailyRotation {
-						err = os.Remove(path.Dir(p))
-						if err != nil {
-							fmt.Println(err)
-						}
-					}
-				}
+	var excludeddatabases string
+	flag.StringVar(&excludeddatabases, "excluded-databases", "", "List of databases excluded to be excluded. OBS: Only valid if -databases is not specified")
 
-			}
-		}
-	}
+	flag.IntVar(&flags.DatabaseRowCountTreshold, "dbthreshold", 10000000, "Do not split mysqldumps, if total rowcount of tables in database is less than dbthreshold value for whole database")
 
-}
+	flag.IntVar(&flags.TableRowCountTreshold, "tablethreshold", 5000000, "Do not split mysqldumps, if rowcount of table is less than dbthreshold value for table")
 
-// CopyFile copies the contents of the file named src to the file named
-// by dst. The file will be created if it does not already exist. If the
-// destination file exists, all it's contents will be replaced by the contents
-// of the source file. The file mode will be copied from the source and
-// the copied data is synced/flushed to stable storage.
-func CopyFile(src, dst string) (err error) {
-	in, err := os.Open(src)
-	if err != nil {
-		return
-	}
-	defer in.Close()
+	flag.IntVar(&flags.BatchSize, "batchsize", 1000000, "Split mysqldumps in order to get each file contains batchsize number of records")
 
-	out, err := os.Create(dst)
-	if err != nil {
-		return
-	}
-	defer func() {
-		if e := out.Close(); e != nil {
-			err = e
-		}
-	}()
+	flag.BoolVar(&flags.ForceSplit, "forcesplit", false, "Split schema and data dumps even if total rowcount of tables in database is less than dbthreshold value. if false one dump file will be created")
 
-	_, err = io.Copy(out, in)
-	if err != nil {
-		return
-	}
+	flag.IntVar(&flags.Parallel, "parallel", 1, "Number of dumps (tables and their chunks) executed at the same time")
 
-	err = out.Sync()
-	if err != nil {
-		return
-	}
+	flag.IntVar(&flags.ParallelPerDatabase, "parallel-per-database", 0, "Maximum number of dumps executed at the same time for one database. 0 = only limited by parallel")
 
-	si, err := os.Stat(src)
-	if err != nil {
-		return
-	}
-	err = os.Chmod(dst, si.Mode())
-	if err != nil {
-		return
-	}
+	flag.BoolVar(&flags.Consistent, "consistent", false, "Dump every table and chunk of the databases from consistent snapshots taken under one brief global read lock before the dumps start, on at most -parallel sessions shared by the databases and held until their last dump. Requires -engine native")
 
-	return
-}
+	flag.StringVar(&flags.AdditionalMySQLDumpArgs, "additionals", "", "Additional parameters that will be appended to mysqldump command")
 
-// CopyDir recursively copies a directory tree, attempting to preserve permissions.
-// Source directory must exist, destination directory must *not* exist.
-// Symlinks are ignored and skipped.
-func CopyDir(src string, dst string) (err error) {
-	src = filepath.Clean(src)
-	dst = filepath.Clean(dst)
+	flag.StringVar(&flags.Engine, "engine", EngineMySQLDump, "Dump engine: mysqldump executes mysqldump-path, native generates the dump with the mysql driver connection")
 
-	si, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-	if !si.IsDir() {
-		return fmt.Errorf("source is not a directory")
-	}
+	var compression string
+	flag.StringVar(&compression, "compression", DefaultCodec, "Compression of the backup files as codec[:level]. Codecs: gzip (levels -2 to 9), zstd (1 to 22), xz (0 to 9), lz4 (0 to 9), none")
 
-	_, err = os.Stat(dst)
-	if err != nil && !os.IsNotExist(err) {
-		return
-	}
-	if err == nil {
-		return fmt.Errorf("destination already exists")
-	}
+	flag.StringVar(&flags.EncryptionRecipientsFile, "encrypt-recipients", "", "Encrypt the backup files with age to the public keys listed in this file, one per line")
 
-	err = os.MkdirAll(dst, si.Mode())
-	if err != nil {
-		return
-	}
+	flag.StringVar(&flags.EncryptionPassphraseFile, "encrypt-passphrase-file", "", "Encrypt the backup files with age using the passphrase stored in the first line of this file")
 
-	entries, err := ioutil.ReadDir(src)
-	if err != nil {
-		return
-	}
+	flag.StringVar(&flags.Storage, "storage", "", "Where the backups are kept: empty for output-dir, s3://bucket/prefix or sftp://user@host[:port]/path to upload each database backup from output-dir and apply the rotation there")
 
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
+	flag.StringVar(&flags.S3Endpoint, "s3-endpoint", "s3.amazonaws.com", "Endpoint of the S3 compatible service, host[:port]")
 
-		if entry.IsDir() {
-			err = CopyDir(srcPath, dstPath)
-			if err != nil {
-				return
-			}
-		} else {
-			// Skip symlinks.
-			if entry.Mode()&os.ModeSymlink != 0 {
-				continue
-			}
+	flag.StringVar(&flags.S3Region, "s3-region", "", "Region of the S3 bucket")
 
-			err = CopyFile(srcPath, dstPath)
-			if err != nil {
-				return
-			}
-		}
-	}
+	flag.BoolVar(&flags.S3Insecure, "s3-insecure", false, "Connect to the S3 endpoint over plain http, e.g. a local MinIO")
 
-	return
-}
+	flag.StringVar(&flags.SFTPKey, "sftp-key", "", "Private key file for the sftp storage, the keys of a running ssh-agent are also tried")
 
-// WriteToFile create a file and writes a specified msg to it
-func WriteToFile(filePath string, msg string) {
-	file, err := os.Create(filePath)
-	if err != nil {
-		log.Fatal("Cannot create file", err)
-	}
-	defer file.Close()
+	flag.StringVar(&flags.SFTPKnownHosts, "sftp-known-hosts", filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), "known_hosts file checked for the host key of the sftp storage")
 
-	fmt.Fprintf(file, msg)
-}
+	flag.IntVar(&flags.Verbosity, "verbosity", 2, "0 = only errors, 1 = important things, 2 = all")
 
-// GetOptions creates Options type from Commandline arguments
-func GetOptions() *Options {
+	var logformat, logfile string
+	defineLogFlags(flag.CommandLine, &logformat, &logfile)
 
-	var hostname string
-	flag.StringVar(&hostname, "hostname", "localhost", "Hostname of the mysql server to connect to")
+	flag.StringVar(&flags.MySQLDumpPath, "mysqldump-path", "/usr/bin/mysqldump", "Absolute path for mysqldump executable.")
 
-	var bind string
-	flag.StringVar(&bind, "bind", "3306", "Port of the mysql server to connect to")
+	flag.StringVar(&flags.OutputDirectory, "output-dir", "", "Default is the value of os.Getwd(). The backup files will be placed to output-dir /{DATABASE_NAME}/{DATABASE_NAME}_{TABLENAME|SCHEMA|DATA|ALL}_{TIMESTAMP}.sql")
 
-	var username string
-	flag.StringVar(&username, "username", "root", "username of the mysql server to connect to")
+	flag.IntVar(&flags.HourlyRotation, "hourly-rotation", 0, "Number of hours keeping a backup. 0 = no hourly backups")
 
-	var password string
-	flag.StringVar(&password, "password", "1234", "password of the mysql server to connect to")
+	flag.IntVar(&flags.DailyRotation, "daily-rotation", 5, "Number of days keeping a backup. 0 = daily backups are never removed")
 
-	var databases string
-	flag.StringVar(&databases, "databases", "--all-databases", "List of databases as comma seperated values to dump. OBS: If not specified, --all-databases is the default")
+	flag.IntVar(&flags.WeeklyRotation, "weekly-rotation", 2, "Number of weeks keeping a backup. 0 = no weekly backups")
 
-	var excludeddatabases string
-	flag.StringVar(&excludeddatabases, "excluded-databases", "", "List of databases excluded to be excluded. OBS: Only valid if -databases is not specified")
+	flag.IntVar(&flags.MonthlyRotation, "monthly-rotation", 1, "Number of months keeping a backup. 0 = no monthly backups")
+
+	flag.IntVar(&flags.YearlyRotation, "yearly-rotation", 0, "Number of years keeping a backup. 0 = no yearly backups")
 
-	var dbthreshold int
-	flag.IntVar(&dbthreshold, "dbthreshold", 10000000, "Do not split mysqldumps, if total rowcount of tables in database is less than dbthreshold value for whole database")
+	var maxtotalsize string
+	flag.StringVar(&maxtotalsize, "max-total-size", "", "Maximum size of the backups of every tier, e.g. 500G. The oldest are removed after each run until they fit")
 
-	var tablethreshold int
-	flag.IntVar(&tablethreshold, "tablethreshold", 5000000, "Do not split mysqldumps, if rowcount of table is less than dbthreshold value for table")
+	var minfreespace string
+	flag.StringVar(&minfreespace, "min-free-space", "", "Free space kept on the filesystem of output-dir, e.g. 50G. The oldest backups are removed after each run until it is available")
 
-	var batchsize int
-	flag.IntVar(&batchsize, "batchsize", 1000000, "Split mysqldumps in order to get each file contains batchsize number of records")
+	flag.StringVar(&flags.Schedule, "schedule", "", "Cron expression of the backups run by mars serve, e.g. \"0 3 * * *\" or @hourly")
 
-	var forcesplit bool
-	flag.BoolVar(&forcesplit, "forcesplit", false, "Split schema and data dumps even if total rowcount of tables in database is less than dbthreshold value. if false one dump file will be created")
+	flag.StringVar(&flags.MetricsTextfile, "metrics-textfile", "", "Write Prometheus metrics to this file after the run, for the node_exporter textfile collector (name it *.prom)")
 
-	var additionals string
-	flag.StringVar(&additionals, "additionals", "", "Additional parameters that will be appended to mysqldump command")
+	flag.StringVar(&flags.MetricsListen, "metrics-listen", "", "Address on which mars serve exposes Prometheus metrics at /metrics, e.g. :9104")
 
-	var verbosity int
-	flag.IntVar(&verbosity, "verbosity", 2, "0 = only errors, 1 = important things, 2 = all")
+	flag.StringVar(&flags.NotifyOn, "notify-on", NotifyAlways, "When notifications are sent: always or failure")
 
-	var mysqldumppath string
-	flag.StringVar(&mysqldumppath, "mysqldump-path", "/usr/bin/mysqldump", "Absolute path for mysqldump executable.")
+	flag.StringVar(&flags.NotifyWebhook, "notify-webhook", "", "URL receiving a JSON summary of each run")
 
-	var outputdir string
-	flag.StringVar(&outputdir, "output-dir", "", "Default is the value of os.Getwd(). The backup files will be placed to output-dir /{DATABASE_NAME}/{DATABASE_NAME}_{TABLENAME|SCHEMA|DATA|ALL}_{TIMESTAMP}.sql")
+	flag.StringVar(&flags.NotifySlack, "notify-slack", "", "Slack compatible incoming webhook URL receiving a text summary of each run")
 
-	var dailyrotation int
-	flag.IntVar(&dailyrotation, "daily-rotation", 5, "Number of days of retention")
+	flag.StringVar(&flags.NotifySMTP, "notify-smtp", "", "SMTP server host:port emailing a summary of each run. Credentials are read from "+SMTPUsernameEnv+" and "+SMTPPasswordEnv)
 
-	var weeklyrotation int
-	flag.IntVar(&weeklyrotation, "weekly-rotation", 2, "Number of weeks of retention")
+	flag.StringVar(&flags.NotifyEmailFrom, "notify-email-from", "", "Sender address of the notification emails")
 
-	var monthlyrotation int
-	flag.IntVar(&monthlyrotation, "monthly-rotation", 1, "Number of months of retention")
+	flag.StringVar(&flags.NotifyEmailTo, "notify-email-to", "", "Comma separated recipient addresses of the notification emails")
+
+	flag.IntVar(&flags.RetryAttempts, "retry-attempts", 3, "Attempts of a dump failing with a lost connection, a deadlock or a lock wait timeout. 1 = no retry")
+
+	flag.DurationVar(&flags.RetryBackoff, "retry-backoff", 10*time.Second, "Wait before the first retry of a dump, doubled after each failed attempt up to 5m")
 
 	var test bool
 	flag.BoolVar(&test, "test", false, "test")
 
-	flag.Parse()
+	var config string
+	flag.StringVar(&config, "config", "", "YAML file with the options of one or more server profiles. Flags given on the command line override its values")
 
-	if outputdir == "" {
-		dir, err := os.Getwd()
-		if err != nil {
+	var profiles string
+	flag.StringVar(&profiles, "profiles", "", "Comma separated names of the config file profiles to back up. Default is every profile")
+
+	flag.CommandLine.Parse(arguments)
+
+	configprofiles, err := LoadConfig(config, profiles)
+	if err != nil {
+		printMessage("error to read config: "+err.Error(), flags.Verbosity, Error)
+		os.Exit(1)
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var all []*Options
+	for i, profile := range configprofiles {
+		if err := profile.Apply(flag.CommandLine, explicit); err != nil {
+			printMessage(err.Error(), flags.Verbosity, Error)
+			os.Exit(1)
+		}
+
+		verbosity := flags.Verbosity
+
+		// the log is shared by every profile of the process, its flags can only be set in the config defaults
+		if i == 0 {
+			if err := SetupLogging(logformat, logfile); err != nil {
+				printMessage(err.Error(), verbosity, Error)
+				os.Exit(1)
+			}
+		}
+
+		if profile.Name != "" {
+			printMessage("Reading profile : "+profile.Name, verbosity, Info)
+		}
+
+		opts := NewOptions(flags, databases, excludeddatabases)
+		opts.Profile = profile.Name
+
+		var err error
+		if !prune {
+			if explicit["password"] {
+				printMessage("-password is visible to other users of this host, prefer the "+PasswordEnv+" environment variable or -password-command", verbosity, Warning)
+			}
+
+			if opts.Password, err = ResolvePassword(opts.Password, opts.PasswordCommand); err != nil {
+				printMessage(err.Error(), verbosity, Error)
+				os.Exit(1)
+			}
+
+			if err := opts.Connection.Validate(); err != nil {
+				printMessage(err.Error(), verbosity, Error)
+				os.Exit(1)
+			}
+		}
+
+		if opts.OutputDirectory == "" {
+			dir, err := os.Getwd()
+			if err != nil {
+				printMessage(err.Error(), verbosity, Error)
+			}
+
+			opts.OutputDirectory = dir
+		}
+
+		opts.DefaultsProvidedByUser = true
+
+		if opts.Compression, opts.CompressionLevel, err = ParseCompression(compression); err != nil {
 			printMessage(err.Error(), verbosity, Error)
+			os.Exit(1)
 		}
 
-		outputdir = dir
-	}
+		if opts.MaxTotalSize, err = ParseSize(maxtotalsize); err != nil {
+			printMessage("max-total-size: "+err.Error(), verbosity, Error)
+			os.Exit(1)
+		}
 
-	defaultsProvidedByUser := true
+		if opts.MinFreeSpace, err = ParseSize(minfreespace); err != nil {
+			printMessage("min-free-space: "+err.Error(), verbosity, Error)
+			os.Exit(1)
+		}
 
-	if _, err := os.Stat(mysqldumppath); os.IsNotExist(err) {
-		printMessage("mysqldump binary can not be found, please specify correct value for mysqldump-path parameter", verbosity, Error)
-		os.Exit(1)
-	}
+		if opts.NotifyOn != NotifyAlways && opts.NotifyOn != NotifyFailure {
+			printMessage("notify-on must be either "+NotifyAlways+" or "+NotifyFailure, verbosity, Error)
+			os.Exit(1)
+		}
+
+		if opts.NotifySMTP != "" && (opts.NotifyEmailFrom == "" || opts.NotifyEmailTo == "") {
+			printMessage("notify-smtp requires notify-email-from and notify-email-to", verbosity, Error)
+			os.Exit(1)
+		}
+
+		// webhook URLs embed their access token, keep them out of the logs
+		registerSecret(opts.NotifyWebhook)
+		registerSecret(opts.NotifySlack)
+		registerSecret(os.Getenv(SMTPPasswordEnv))
+
+		if !prune {
+			if opts.Engine != EngineMySQLDump && opts.Engine != EngineNative {
+				printMessage("engine must be either "+EngineMySQLDump+" or "+EngineNative, verbosity, Error)
+				os.Exit(1)
+			}
+
+			if opts.Consistent && opts.Engine != EngineNative {
+				printMessage("consistent snapshots are shared between dumps by the native engine only, please use -engine native", verbosity, Error)
+				os.Exit(1)
+			}
+
+			if _, err := os.Stat(opts.MySQLDumpPath); opts.Engine == EngineMySQLDump && os.IsNotExist(err) {
+				printMessage("mysqldump binary can not be found, please specify correct value for mysqldump-path parameter", verbosity, Error)
+				os.Exit(1)
+			}
+
+			if opts.EncryptionRecipients, err = LoadRecipients(opts.EncryptionRecipientsFile, opts.EncryptionPassphraseFile); err != nil {
+				printMessage("error to load encryption keys: "+err.Error(), verbosity, Error)
+				os.Exit(1)
+			}
+
+			os.MkdirAll(opts.OutputDirectory+"/daily/"+timeNow.Format("2006-01-02"), os.ModePerm)
+			os.MkdirAll(opts.OutputDirectory+"/weekly", os.ModePerm)
+			os.MkdirAll(opts.OutputDirectory+"/monthly", os.ModePerm)
+		}
+
+		stropts, _ := json.MarshalIndent(redactedOptions(*opts), "", "\t")
+		printMessage("Running with parameters", verbosity, Info)
+		printMessage(string(stropts), verbosity, Info)
+		printMessage("Running on operating system : "+runtime.GOOS, verbosity, Info)
+
+		if test {
+			cmd := exec.Command(opts.MySQLDumpPath,
+				`-h127.0.0.1`,
+				`-uroot`,
+				`-pXXXX`,
+				`--no-create-db`,
+				`--skip-triggers`,
+				`--no-create-info`,
+				`--single-transaction`,
+				`--skip-extended-insert`,
+				`--quick`,
+				`--skip-add-locks`,
+				`--default-character-set=utf8`,
+				`--compress`,
+				`mysql`,
+				`--where="1=1 LIMIT 1000000, 1000000"`,
+				`user`,
+				`host`)
+
+			cmdOut, _ := cmd.StdoutPipe()
+			cmdErr, _ := cmd.StderrPipe()
+
+			cmd.Start()
+
+			output, _ := ioutil.ReadAll(cmdOut)
+			err, _ := ioutil.ReadAll(cmdErr)
+
+			cmd.Wait()
+
+			printMessage("mysqldump output is : "+string(output), opts.Verbosity, Info)
+
+			if string(err) != "" {
+				printMessage("mysqldump error is: "+string(err), opts.Verbosity, Error)
+				os.Exit(4)
+			}
 
-	os.MkdirAll(outputdir+"/daily/"+timeNow.Format("2006-01-02"), os.ModePerm)
-	os.MkdirAll(outputdir+"/weekly", os.ModePerm)
-	os.MkdirAll(outputdir+"/monthly", os.ModePerm)
-
-	opts := NewOptions(hostname, bind, username, password, databases, excludeddatabases, dbthreshold, tablethreshold, batchsize, forcesplit, additionals, verbosity, mysqldumppath, outputdir, defaultsProvidedByUser, dailyrotation, weeklyrotation, monthlyrotation)
-	stropts, _ := json.MarshalIndent(opts, "", "\t")
-	printMessage("Running with parameters", verbosity, Info)
-	printMessage(string(stropts), verbosity, Info)
-	printMessage("Running on operating system : "+runtime.GOOS, verbosity, Info)
-
-	if test {
-		cmd := exec.Command(opts.MySQLDumpPath,
-			`-h127.0.0.1`,
-			`-uroot`,
-			`-pXXXX`,
-			`--no-create-db`,
-			`--skip-triggers`,
-			`--no-create-info`,
-			`--single-transaction`,
-			`--skip-extended-insert`,
-			`--quick`,
-			`--skip-add-locks`,
-			`--default-character-set=utf8`,
-			`--compress`,
-			`mysql`,
-			`--where="1=1 LIMIT 1000000, 1000000"`,
-			`user`,
-			`host`)
-
-		cmdOut, _ := cmd.StdoutPipe()
-		cmdErr, _ := cmd.StderrPipe()
-
-		cmd.Start()
-
-		output, _ := ioutil.ReadAll(cmdOut)
-		err, _ := ioutil.ReadAll(cmdErr)
-
-		cmd.Wait()
-
-		printMessage("mysqldump output is : "+string(output), opts.Verbosity, Info)
-
-		if string(err) != "" {
-			printMessage("mysqldump error is: "+string(err), opts.Verbosity, Error)
 			os.Exit(4)
 		}
 
-		os.Exit(4)
+		all = append(all, opts)
 	}
 
-	return opts
+	return all
 }
 
+// printMessage prints an event without structured fields, see printEvent
 func printMessage(message string, verbosity int, messageType int) {
-	colors := map[int]color.Attribute{Info: color.FgGreen, Warning: color.FgHiYellow, Error: color.FgHiRed}
-
-	if verbosity == 2 {
-		color.Set(colors[messageType])
-		fmt.Println(message)
-		color.Unset()
-	} else if verbosity == 1 && messageType > 1 {
-		color.Set(colors[messageType])
-		fmt.Println(message)
-		color.Unset()
-	} else if verbosity == 0 && messageType > 2 {
-		color.Set(colors[messageType])
-		fmt.Println(message)
-		color.Unset()
-	}
-}
-
-func checkErr(err error) {
-	if err != nil {
-		color.Set(color.FgHiRed)
-		panic(err)
-		color.Unset()
-	}
+	printEvent(message, verbosity, messageType, nil)
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPublishBackup(t *testing.T) {
+	const dir = "daily/2017-08-05/shop-2017-08-05"
+
+	tests := []struct {
+		name      string
+		earlier   string
+		failed    bool
+		published bool
+		want      map[string]string
+	}{
+		{
+			name:      "first run",
+			published: true,
+			want:      map[string]string{"shop_ALL.sql.gz": "new", ManifestFilename: `{"Status": "success"}`},
+		},
+		{
+			name:      "later successful run",
+			earlier:   "success",
+			published: true,
+			want:      map[string]string{"shop_ALL.sql.gz": "new", "shop_orders1.sql.gz": "earlier", ManifestFilename: `{"Status": "success"}`},
+		},
+		{
+			name:    "later failed run",
+			earlier: "success",
+			failed:  true,
+			want:    map[string]string{"shop_ALL.sql.gz": "earlier", "shop_orders1.sql.gz": "earlier", ManifestFilename: `{"Status": "success"}`},
+		},
+		{
+			name:      "failed run after a failed run",
+			earlier:   "failed",
+			failed:    true,
+			published: true,
+			want:      map[string]string{"shop_ALL.sql.gz": "new", "shop_orders1.sql.gz": "earlier", ManifestFilename: `{"Status": "failed"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &LocalStorage{Root: t.TempDir()}
+
+			if test.earlier != "" {
+				putString(t, storage, dir+"/shop_ALL.sql.gz", "earlier")
+				putString(t, storage, dir+"/shop_orders1.sql.gz", "earlier")
+				putString(t, storage, dir+"/"+ManifestFilename, `{"Status": "success"}`)
+				if test.earlier == "failed" {
+					putString(t, storage, dir+"/"+ManifestFilename, `{"Status": "failed"}`)
+				}
+			}
+
+			status := `{"Status": "success"}`
+			if test.failed {
+				status = `{"Status": "failed"}`
+			}
+			putString(t, storage, ".partial/run/shop_ALL.sql.gz", "new")
+			putString(t, storage, ".partial/run/"+ManifestFilename, status)
+
+			published, err := publishBackup(filepath.Join(storage.Root, ".partial/run"), filepath.Join(storage.Root, dir), test.failed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if published != test.published {
+				t.Errorf("published = %t, want %t", published, test.published)
+			}
+
+			got := map[string]string{}
+			for _, key := range listKeys(t, storage, dir+"/") {
+				got[key[len(dir)+1:]] = getString(t, storage, key)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("files = %v, want %v", got, test.want)
+			}
+
+			if keys := listKeys(t, storage, ".partial/"); len(keys) != 0 {
+				t.Errorf("staging directory left: %v", keys)
+			}
+		})
+	}
+}
+
+func TestRemoveStaleStaging(t *testing.T) {
+	storage := &LocalStorage{Root: t.TempDir()}
+	old := time.Now().Add(-2 * staleStagingAge)
+
+	putString(t, storage, ".partial/interrupted/shop_ALL.sql.gz", "old")
+	putString(t, storage, ".partial/running/shop_ALL.sql.gz", "new")
+	putString(t, storage, ".partial/queued/blog_ALL.sql.gz", "new")
+	for _, name := range []string{".partial/interrupted/shop_ALL.sql.gz", ".partial/interrupted", ".partial/queued"} {
+		if err := os.Chtimes(filepath.Join(storage.Root, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(storage.Root, ".partial/empty"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(storage.Root, ".partial/empty"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removeStaleStaging(Options{OutputDirectory: storage.Root, Verbosity: -1})
+
+	got := listKeys(t, storage, ".partial/")
+	want := []string{".partial/queued/blog_ALL.sql.gz", ".partial/running/shop_ALL.sql.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("staging files = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(storage.Root, ".partial/empty")); !os.IsNotExist(err) {
+		t.Errorf("empty stale staging directory kept")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	lastSuccessMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mars_backup_last_success_timestamp_seconds",
+		Help: "Time the last successful backup of the database finished.",
+	}, []string{"host", "database"})
+
+	lastStatusMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mars_backup_last_status",
+		Help: "1 when the last backup of the database succeeded, 0 when it failed.",
+	}, []string{"host", "database"})
+
+	durationMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mars_backup_duration_seconds",
+		Help: "Duration of the last backup of the database.",
+	}, []string{"host", "database"})
+
+	bytesMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mars_backup_bytes",
+		Help: "Size of the archives written by the last backup of the database.",
+	}, []string{"host", "database"})
+
+	rowsMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mars_backup_rows",
+		Help: "Rows dumped by the last backup of the database, native engine only.",
+	}, []string{"host", "database"})
+
+	chunksMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mars_backup_chunks",
+		Help: "Archives written by the last backup of the database.",
+	}, []string{"host", "database"})
+
+	dumpFailuresMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mars_backup_dump_failures_total",
+		Help: "Dumps of the database that failed.",
+	}, []string{"host", "database"})
+
+	dumpRetriesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mars_backup_dump_retries_total",
+		Help: "Dumps of the database retried after a transient failure.",
+	}, []string{"host", "database"})
+
+	rotationDeletionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mars_backup_rotation_deletions_total",
+		Help: "Backup directories removed by the rotation.",
+	}, []string{"host", "tier"})
+)
+
+// metricsSampleRegexp matches a sample of the text format, metricsLabelRegexp one of its labels
+var (
+	metricsSampleRegexp = regexp.MustCompile(`^(\w+)\{(.*)\} (\S+)$`)
+	metricsLabelRegexp  = regexp.MustCompile(`(\w+)="((?:[^"\\]|\\.)*)"`)
+)
+
+func init() {
+	metricsRegistry.MustRegister(lastSuccessMetric, lastStatusMetric, durationMetric, bytesMetric, rowsMetric, chunksMetric, dumpFailuresMetric, dumpRetriesMetric, rotationDeletionsMetric)
+}
+
+// recordDatabaseMetrics updates the metrics of a database once all its dumps are done
+func recordDatabaseMetrics(options Options, manifest *Manifest, failed bool) {
+	host, db := options.HostName, manifest.Database
+
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+
+	if failed {
+		recordDatabaseFailure(options, db)
+		return
+	}
+
+	var size, rows int64
+	for _, file := range manifest.Files {
+		size += file.Size
+		if file.Rows != nil {
+			rows += *file.Rows
+		}
+	}
+
+	lastStatusMetric.WithLabelValues(host, db).Set(1)
+	lastSuccessMetric.WithLabelValues(host, db).Set(float64(manifest.FinishedAt.Unix()))
+	durationMetric.WithLabelValues(host, db).Set(manifest.FinishedAt.Sub(manifest.StartedAt).Seconds())
+	bytesMetric.WithLabelValues(host, db).Set(float64(size))
+	rowsMetric.WithLabelValues(host, db).Set(float64(rows))
+	chunksMetric.WithLabelValues(host, db).Set(float64(len(manifest.Files)))
+}
+
+// recordDatabaseFailure marks the last backup of database db as failed
+func recordDatabaseFailure(options Options, db string) {
+	lastStatusMetric.WithLabelValues(options.HostName, db).Set(0)
+}
+
+// recordDumpFailure counts a failed dump of database db
+func recordDumpFailure(options Options, db string) {
+	dumpFailuresMetric.WithLabelValues(options.HostName, db).Inc()
+}
+
+// recordDumpRetry counts a retried dump of database db
+func recordDumpRetry(options Options, db string) {
+	dumpRetriesMetric.WithLabelValues(options.HostName, db).Inc()
+}
+
+// recordRotationDeletion counts a backup directory removed from tier
+func recordRotationDeletion(options Options, tier string) {
+	rotationDeletionsMetric.WithLabelValues(options.HostName, tier).Inc()
+}
+
+// LoadMetricsTextfile reads the last success timestamps of a textfile written by an earlier run,
+// so a failed run does not reset them
+func LoadMetricsTextfile(filename string) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		match := metricsSampleRegexp.FindStringSubmatch(scanner.Text())
+		if match == nil || match[1] != "mars_backup_last_success_timestamp_seconds" {
+			continue
+		}
+
+		labels := map[string]string{}
+		for _, label := range metricsLabelRegexp.FindAllStringSubmatch(match[2], -1) {
+			labels[label[1]] = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n").Replace(label[2])
+		}
+
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			continue
+		}
+
+		lastSuccessMetric.WithLabelValues(labels["host"], labels["database"]).Set(value)
+	}
+
+	return scanner.Err()
+}
+
+// WriteMetricsTextfile writes the metrics for the node_exporter textfile collector
+func WriteMetricsTextfile(filename string) error {
+	return prometheus.WriteToTextfile(filename, metricsRegistry)
+}
+
+// ServeMetrics exposes the metrics on address at /metrics in the background
+func ServeMetrics(address string, verbosity int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			printMessage("error to serve metrics on "+address+": "+err.Error(), verbosity, Error)
+		}
+	}()
+
+	printMessage("Serving metrics on "+address+"/metrics", verbosity, Info)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// nativeMaxStatementSize is the size after which a new INSERT statement is started,
+// the same value mysqldump uses for net_buffer_length
+const nativeMaxStatementSize = 1024 * 1024
+
+// queryer is implemented by *sql.DB, *sql.Tx and snapshot sessions, the native engine can dump from any of them
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Column model for the information_schema metadata the native engine needs per column
+type Column struct {
+	Name     string
+	DataType string
+}
+
+// sqlWriter remembers the first write error so dump code does not have to check every line
+type sqlWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *sqlWriter) printf(format string, a ...interface{}) {
+	if s.err != nil {
+		return
+	}
+	_, s.err = fmt.Fprintf(s.w, format, a...)
+}
+
+func (s *sqlWriter) write(b []byte) {
+	if s.err != nil {
+		return
+	}
+	_, s.err = s.w.Write(b)
+}
+
+// nativeDataSourceName returns the go-sql-driver DSN used by the native engine, whose sessions run in UTC
+func nativeDataSourceName(options Options, database string) (string, error) {
+	return options.DataSourceName(database, map[string]string{"time_zone": "'+00:00'"})
+}
+
+func runNativeDump(options Options, request DumpRequest, w io.Writer) (int64, error) {
+	if options.AdditionalMySQLDumpArgs != "" {
+		printMessage("additionals are mysqldump parameters and are ignored by the native engine", options.Verbosity, Warning)
+	}
+
+	printEvent("native dump is being executed for database : "+request.Database+" "+strings.Join(request.Tables, " "), options.Verbosity, Info, LogFields{"database": request.Database})
+
+	var q queryer
+	if request.Snapshot != nil {
+		session, err := request.Snapshot.Acquire()
+		if err != nil {
+			return 0, err
+		}
+		defer request.Snapshot.Release(session)
+		q = session
+	} else {
+		dsn, err := nativeDataSourceName(options, request.Database)
+		if err != nil {
+			return 0, err
+		}
+
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		q = db
+	}
+
+	buffered := bufio.NewWriterSize(w, nativeMaxStatementSize)
+
+	rows, err := NativeDump(q, buffered, options.HostName, options.Charset, request)
+	if err != nil {
+		return rows, err
+	}
+
+	return rows, buffered.Flush()
+}
+
+// NativeDump writes the SQL described by request to w, in the same layout as mysqldump, and returns the number of rows dumped
+func NativeDump(q queryer, w io.Writer, hostname string, charset string, request DumpRequest) (int64, error) {
+	out := &sqlWriter{w: w}
+
+	var version string
+	if err := q.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	tables, views, err := listTablesAndViews(q, request.Tables)
+	if err != nil {
+		return 0, err
+	}
+
+	out.printf("-- Mars native dump\n--\n")
+	out.printf("-- Host: %s    Database: %s\n", hostname, request.Database)
+	out.printf("-- ------------------------------------------------------\n")
+	out.printf("-- Server version\t%s\n\n", version)
+	out.printf("/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n")
+	out.printf("/*!40101 SET NAMES %s */;\n", charset)
+	out.printf("/*!40103 SET @OLD_TIME_ZONE=@@TIME_ZONE */;\n")
+	out.printf("/*!40103 SET TIME_ZONE='+00:00' */;\n")
+	out.printf("/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;\n")
+	out.printf("/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;\n")
+	out.printf("/*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;\n")
+	out.printf("/*!40111 SET @OLD_SQL_NOTES=@@SQL_NOTES, SQL_NOTES=0 */;\n")
+
+	var rows int64
+	for _, table := range tables {
+		if !request.NoCreateInfo {
+			if err := dumpTableStructure(q, out, table); err != nil {
+				return rows, err
+			}
+		}
+
+		if !request.NoData {
+			count, err := dumpTableData(q, out, request.Database, table, request.Where)
+			rows += count
+			if err != nil {
+				return rows, err
+			}
+		}
+
+		if !request.SkipTriggers {
+			if err := dumpTableTriggers(q, out, request.Database, table); err != nil {
+				return rows, err
+			}
+		}
+	}
+
+	if !request.NoCreateInfo {
+		// a view may select from a view whose name sorts after it: as mysqldump does, every view is first
+		// created as a placeholder with the same columns, then replaced by its definition
+		for _, view := range views {
+			if err := dumpViewPlaceholder(q, out, request.Database, view); err != nil {
+				return rows, err
+			}
+		}
+
+		for _, view := range views {
+			if err := dumpViewStructure(q, out, view); err != nil {
+				return rows, err
+			}
+		}
+	}
+
+	out.printf("\n/*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;\n")
+	out.printf("/*!40101 SET SQL_MODE=@OLD_SQL_MODE */;\n")
+	out.printf("/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;\n")
+	out.printf("/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;\n")
+	out.printf("/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;\n")
+	out.printf("/*!40111 SET SQL_NOTES=@OLD_SQL_NOTES */;\n\n")
+	out.printf("-- Dump completed on %s\n", time.Now().Format("2006-01-02 15:04:05"))
+
+	return rows, out.err
+}
+
+// listTablesAndViews returns the base tables and the views of the current database, only those of names when it is not empty.
+// Views have no data to dump, their rows are those of the tables they select from.
+func listTablesAndViews(q queryer, names []string) ([]string, []string, error) {
+	rows, err := q.Query("SHOW FULL TABLES")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	types := map[string]string{}
+	var all []string
+	for rows.Next() {
+		var name, tableType string
+		if err := rows.Scan(&name, &tableType); err != nil {
+			return nil, nil, err
+		}
+
+		types[name] = tableType
+		all = append(all, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(names) == 0 {
+		names = all
+	}
+
+	var tables, views []string
+	for _, name := range names {
+		if types[name] == "VIEW" {
+			views = append(views, name)
+		} else {
+			tables = append(tables, name)
+		}
+	}
+
+	return tables, views, nil
+}
+
+func dumpTableStructure(q queryer, out *sqlWriter, table string) error {
+	var name, statement string
+	if err := q.QueryRow("SHOW CREATE TABLE "+quoteIdentifier(table)).Scan(&name, &statement); err != nil {
+		return err
+	}
+
+	out.printf("\n--\n-- Table structure for table %s\n--\n\n", quoteIdentifier(table))
+	out.printf("DROP TABLE IF EXISTS %s;\n", quoteIdentifier(table))
+	out.printf("%s;\n", statement)
+
+	return out.err
+}
+
+// dumpViewPlaceholder creates view as a view of constants with the columns of view, so that the views
+// selecting from it can be created before its own definition
+func dumpViewPlaceholder(q queryer, out *sqlWriter, database string, view string) error {
+	rows, err := q.Query("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", database, view)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		columns = append(columns, " 1 AS "+quoteIdentifier(column))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	out.printf("\n--\n-- Temporary view structure for view %s\n--\n\n", quoteIdentifier(view))
+	out.printf("DROP TABLE IF EXISTS %s;\n", quoteIdentifier(view))
+	out.printf("DROP VIEW IF EXISTS %s;\n", quoteIdentifier(view))
+	out.printf("CREATE VIEW %s AS SELECT\n%s;\n", quoteIdentifier(view), strings.Join(columns, ",\n"))
+
+	return out.err
+}
+
+func dumpViewStructure(q queryer, out *sqlWriter, view string) error {
+	var name, statement, charset, collation string
+	if err := q.QueryRow("SHOW CREATE VIEW "+quoteIdentifier(view)).Scan(&name, &statement, &charset, &collation); err != nil {
+		return err
+	}
+
+	out.printf("\n--\n-- Final view structure for view %s\n--\n\n", quoteIdentifier(view))
+	out.printf("DROP VIEW IF EXISTS %s;\n", quoteIdentifier(view))
+	out.printf("%s;\n", statement)
+
+	return out.err
+}
+
+func dumpTableTriggers(q queryer, out *sqlWriter, database string, table string) error {
+	rows, err := q.Query("SELECT TRIGGER_NAME FROM information_schema.TRIGGERS WHERE EVENT_OBJECT_SCHEMA = ? AND EVENT_OBJECT_TABLE = ? ORDER BY ACTION_ORDER", database, table)
+	if err != nil {
+		return err
+	}
+
+	var triggers []string
+	for rows.Next() {
+		var trigger string
+		if err := rows.Scan(&trigger); err != nil {
+			rows.Close()
+			return err
+		}
+		triggers = append(triggers, trigger)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, trigger := range triggers {
+		// Trigger, sql_mode, SQL Original Statement, ... the trailing columns differ between server versions
+		rows, err := q.Query("SHOW CREATE TRIGGER " + quoteIdentifier(trigger))
+		if err != nil {
+			return err
+		}
+
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		values := make([]sql.RawBytes, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+
+			out.printf("\n/*!50003 SET @saved_sql_mode = @@sql_mode */ ;\n")
+			out.printf("/*!50003 SET sql_mode = '%s' */ ;\n", values[1])
+			out.printf("DELIMITER ;;\n%s ;;\nDELIMITER ;\n", values[2])
+			out.printf("/*!50003 SET sql_mode = @saved_sql_mode */ ;\n")
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	return out.err
+}
+
+// insertableColumns returns the columns of table that can be given a value, generated columns are left out
+func insertableColumns(q queryer, database string, table string) ([]Column, error) {
+	rows, err := q.Query("SELECT COLUMN_NAME, DATA_TYPE, EXTRA FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", database, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []Column
+	for rows.Next() {
+		var column Column
+		var extra string
+		if err := rows.Scan(&column.Name, &column.DataType, &extra); err != nil {
+			return nil, err
+		}
+
+		extra = strings.ToUpper(extra)
+		if strings.Contains(extra, "VIRTUAL GENERATED") || strings.Contains(extra, "STORED GENERATED") {
+			continue
+		}
+
+		column.DataType = strings.ToLower(column.DataType)
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// dumpTableData writes the rows of table matching where as INSERT statements and returns how many were written
+func dumpTableData(q queryer, out *sqlWriter, database string, table string, where string) (int64, error) {
+	var count int64
+
+	columns, err := insertableColumns(q, database, table)
+	if err != nil {
+		return count, err
+	}
+
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = quoteIdentifier(column.Name)
+	}
+
+	query := "SELECT /*!40001 SQL_NO_CACHE */ " + strings.Join(names, ",") + " FROM " + quoteIdentifier(table)
+	if where != "" {
+		query += " WHERE " + where
+	}
+
+	rows, err := q.Query(query)
+	if err != nil {
+		return count, err
+	}
+	defer rows.Close()
+
+	out.printf("\n--\n-- Dumping data for table %s\n--\n\n", quoteIdentifier(table))
+	out.printf("/*!40000 ALTER TABLE %s DISABLE KEYS */;\n", quoteIdentifier(table))
+
+	prefix := "INSERT INTO " + quoteIdentifier(table) + " (" + strings.Join(names, ",") + ") VALUES "
+
+	values := make([][]byte, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	var statement, row bytes.Buffer
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return count, err
+		}
+		count++
+
+		row.Reset()
+		encodeRow(&row, columns, values)
+
+		if statement.Len() > 0 && statement.Len()+row.Len()+2 > nativeMaxStatementSize {
+			statement.WriteString(";\n")
+			out.write(statement.Bytes())
+			statement.Reset()
+		}
+
+		if statement.Len() == 0 {
+			statement.WriteString(prefix)
+		} else {
+			statement.WriteByte(',')
+		}
+		statement.Write(row.Bytes())
+	}
+
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	if statement.Len() > 0 {
+		statement.WriteString(";\n")
+		out.write(statement.Bytes())
+	}
+
+	out.printf("/*!40000 ALTER TABLE %s ENABLE KEYS */;\n", quoteIdentifier(table))
+
+	return count, out.err
+}
+
+// encodeRow writes values as a parenthesized SQL tuple
+func encodeRow(buf *bytes.Buffer, columns []Column, values [][]byte) {
+	buf.WriteByte('(')
+	for i, value := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encodeValue(buf, columns[i].DataType, value)
+	}
+	buf.WriteByte(')')
+}
+
+// encodeValue writes value as a SQL literal for a column of dataType (information_schema DATA_TYPE)
+func encodeValue(buf *bytes.Buffer, dataType string, value []byte) {
+	if value == nil {
+		buf.WriteString("NULL")
+		return
+	}
+
+	switch dataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "decimal", "numeric", "float", "double", "real", "year":
+		buf.Write(value)
+	case "bit", "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob",
+		"geometry", "point", "linestring", "polygon", "multipoint", "multilinestring", "multipolygon", "geometrycollection", "geomcollection":
+		if len(value) == 0 {
+			buf.WriteString("''")
+			return
+		}
+		buf.WriteString("0x")
+		buf.WriteString(hex.EncodeToString(value))
+	default:
+		buf.WriteByte('\'')
+		escapeString(buf, value)
+		buf.WriteByte('\'')
+	}
+}
+
+// escapeString escapes the same characters as mysql_real_escape_string
+func escapeString(buf *bytes.Buffer, value []byte) {
+	for _, c := range value {
+		switch c {
+		case 0:
+			buf.WriteString(`\0`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\'':
+			buf.WriteString(`\'`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\032':
+			buf.WriteString(`\Z`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
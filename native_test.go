@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeResults maps a query, followed by its arguments, to the rows the fake driver returns: columns then values
+var fakeResults = map[string][][]string{}
+
+// fakeExecs records the statements executed through the fake driver
+var fakeExecs []string
+
+func init() {
+	sql.Register("mars-fake", fakeDriver{})
+}
+
+// fakeDriver is a database/sql driver answering the queries of fakeResults, for the native engine tests
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{query: query}, nil
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions not supported")
+}
+
+type fakeStmt struct {
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	fakeExecs = append(fakeExecs, s.query)
+	return driver.RowsAffected(0), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	key := s.query
+	for _, arg := range args {
+		key += fmt.Sprintf(" %v", arg)
+	}
+
+	result, ok := fakeResults[key]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query %q", key)
+	}
+
+	return &fakeRows{columns: result[0], values: result[1:]}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]string
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+
+	for i, value := range r.values[0] {
+		dest[i] = []byte(value)
+	}
+	r.values = r.values[1:]
+
+	return nil
+}
+
+func TestEncodeValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataType string
+		value    []byte
+		want     string
+	}{
+		{"null string", "varchar", nil, "NULL"},
+		{"null integer", "int", nil, "NULL"},
+		{"null blob", "blob", nil, "NULL"},
+		{"integer", "bigint", []byte("-42"), "-42"},
+		{"decimal", "decimal", []byte("3.14"), "3.14"},
+		{"year", "year", []byte("2017"), "2017"},
+		{"string", "varchar", []byte("mars"), "'mars'"},
+		{"empty string", "varchar", []byte{}, "''"},
+		{"datetime", "datetime", []byte("2017-08-05 10:00:00"), "'2017-08-05 10:00:00'"},
+		{"quotes", "text", []byte(`it's "quoted"`), `'it\'s \"quoted\"'`},
+		{"backslash", "text", []byte(`C:\tmp`), `'C:\\tmp'`},
+		{"binary", "varbinary", []byte{0x00, 0xff, '\'', '\\'}, "0x00ff275c"},
+		{"empty binary", "blob", []byte{}, "''"},
+		{"bit", "bit", []byte{0x05}, "0x05"},
+		{"geometry", "point", []byte{0x01, 0x02}, "0x0102"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			encodeValue(&buf, test.dataType, test.value)
+			if got := buf.String(); got != test.want {
+				t.Errorf("encodeValue(%q, %q) = %s, want %s", test.dataType, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEscapeString(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"", ""},
+		{"a'b", `a\'b`},
+		{`a"b`, `a\"b`},
+		{`a\b`, `a\\b`},
+		{`\'`, `\\\'`},
+		{"line\nbreak", `line\nbreak`},
+		{"carriage\rreturn", `carriage\rreturn`},
+		{"nul\x00byte", `nul\0byte`},
+		{"ctrl\x1az", `ctrl\Zz`},
+		{"tab\tkept", "tab\tkept"},
+		{"utf8 é ü", "utf8 é ü"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		escapeString(&buf, []byte(test.value))
+		if got := buf.String(); got != test.want {
+			t.Errorf("escapeString(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestEncodeRow(t *testing.T) {
+	columns := []Column{{Name: "id", DataType: "int"}, {Name: "name", DataType: "varchar"}, {Name: "data", DataType: "blob"}}
+
+	var buf bytes.Buffer
+	encodeRow(&buf, columns, [][]byte{[]byte("1"), []byte("o'neil"), nil})
+
+	if want := `(1,'o\'neil',NULL)`; buf.String() != want {
+		t.Errorf("encodeRow = %s, want %s", buf.String(), want)
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"users":     "`users`",
+		"my table":  "`my table`",
+		"we`ird":    "`we``ird`",
+		"`; DROP x": "```; DROP x`",
+	}
+
+	for name, want := range tests {
+		if got := quoteIdentifier(name); got != want {
+			t.Errorf("quoteIdentifier(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestNativeDumpViewOnLaterView(t *testing.T) {
+	columns := "SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION shop "
+	fakeResults = map[string][][]string{
+		"SELECT VERSION()":            {{"VERSION()"}, {"8.0.36"}},
+		"SHOW FULL TABLES":            {{"Tables_in_shop", "Table_type"}, {"a_report", "VIEW"}, {"b_totals", "VIEW"}, {"orders", "BASE TABLE"}},
+		"SHOW CREATE TABLE `orders`":  {{"Table", "Create Table"}, {"orders", "CREATE TABLE `orders` (`id` int, `total` int)"}},
+		columns + "a_report":          {{"COLUMN_NAME"}, {"total"}},
+		columns + "b_totals":          {{"COLUMN_NAME"}, {"id"}, {"total"}},
+		"SHOW CREATE VIEW `a_report`": {{"View", "Create View", "character_set_client", "collation_connection"}, {"a_report", "CREATE VIEW `a_report` AS select `total` from `b_totals`", "utf8mb4", "utf8mb4_general_ci"}},
+		"SHOW CREATE VIEW `b_totals`": {{"View", "Create View", "character_set_client", "collation_connection"}, {"b_totals", "CREATE VIEW `b_totals` AS select `id`, `total` from `orders`", "utf8mb4", "utf8mb4_general_ci"}},
+	}
+
+	db, err := sql.Open("mars-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var buf bytes.Buffer
+	if _, err := NativeDump(db, &buf, "localhost", "utf8mb4", DumpRequest{Database: "shop", NoData: true, SkipTriggers: true}); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+
+	// a_report selects from b_totals: b_totals must exist, as a placeholder, when a_report is created
+	statements := []string{
+		"CREATE TABLE `orders`",
+		"CREATE VIEW `a_report` AS SELECT\n 1 AS `total`;",
+		"CREATE VIEW `b_totals` AS SELECT\n 1 AS `id`,\n 1 AS `total`;",
+		"CREATE VIEW `a_report` AS select `total` from `b_totals`;",
+		"DROP VIEW IF EXISTS `b_totals`;\nCREATE VIEW `b_totals` AS select `id`, `total` from `orders`;",
+	}
+
+	last := -1
+	for _, statement := range statements {
+		i := strings.Index(dump, statement)
+		if i < 0 {
+			t.Fatalf("dump does not hold %q:\n%s", statement, dump)
+		}
+		if i < last {
+			t.Errorf("%q is out of order:\n%s", statement, dump)
+		}
+		last = i
+	}
+}
+
+func TestNativeDumpSplitSkipsViewData(t *testing.T) {
+	fakeResults = map[string][][]string{
+		"SELECT VERSION()": {{"VERSION()"}, {"8.0.36"}},
+		"SHOW FULL TABLES": {{"Tables_in_shop", "Table_type"}, {"orders", "BASE TABLE"}, {"v_totals", "VIEW"}},
+		"SELECT COLUMN_NAME, DATA_TYPE, EXTRA FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION shop orders": {{"COLUMN_NAME", "DATA_TYPE", "EXTRA"}, {"total", "int", ""}},
+		"SELECT /*!40001 SQL_NO_CACHE */ `total` FROM `orders` WHERE `id` >= 1":                                                                                {{"total"}, {"42"}},
+	}
+
+	db, err := sql.Open("mars-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		table string
+		want  string
+	}{
+		{"orders", "INSERT INTO `orders` (`total`) VALUES (42);"},
+		// a view selects the rows of its tables, dumping them would insert them twice on restore
+		{"v_totals", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			// the request of a chunk job in split mode
+			request := DumpRequest{Database: "shop", Tables: []string{test.table}, Where: "`id` >= 1", NoCreateDB: true, NoCreateInfo: true, SkipTriggers: true}
+
+			var buf bytes.Buffer
+			rows, err := NativeDump(db, &buf, "localhost", "utf8mb4", request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dump := buf.String()
+			switch {
+			case test.want == "" && (rows != 0 || strings.Contains(dump, "INSERT INTO")):
+				t.Errorf("dump of %s holds %d rows:\n%s", test.table, rows, dump)
+			case test.want != "" && !strings.Contains(dump, test.want):
+				t.Errorf("dump of %s does not hold %q:\n%s", test.table, test.want, dump)
+			}
+		})
+	}
+}
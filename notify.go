@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When notifications are sent
+const (
+	// NotifyAlways sends a notification after every run
+	NotifyAlways = "always"
+
+	// NotifyFailure sends a notification after failed runs only
+	NotifyFailure = "failure"
+)
+
+// SMTP credentials are read from the environment, not from flags
+const (
+	SMTPUsernameEnv = "MARS_SMTP_USERNAME"
+	SMTPPasswordEnv = "MARS_SMTP_PASSWORD"
+)
+
+// notifyTimeout bounds the time spent on each webhook call
+const notifyTimeout = 30 * time.Second
+
+// RunSummary model for the outcome of a backup run, sent to the notifiers
+type RunSummary struct {
+	Profile    string
+	HostName   string
+	Status     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Duration   float64
+	Size       int64
+	Databases  []DatabaseSummary
+	Errors     []string
+
+	mu sync.Mutex
+}
+
+// DatabaseSummary model for the outcome of the backup of one database
+type DatabaseSummary struct {
+	Database string
+	Status   string
+	Files    int
+	Size     int64
+	Duration float64
+}
+
+// NewRunSummary returns a new RunSummary instance for a run of options, started now
+func NewRunSummary(options Options) *RunSummary {
+	return &RunSummary{
+		Profile:   options.Profile,
+		HostName:  options.HostName,
+		StartedAt: time.Now(),
+	}
+}
+
+// AddDatabase records the outcome of a database, it is safe to call from concurrent jobs
+func (s *RunSummary) AddDatabase(database DatabaseSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Databases = append(s.Databases, database)
+}
+
+// Succeeded returns the number of databases backed up successfully so far
+func (s *RunSummary) Succeeded() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	succeeded := 0
+	for _, database := range s.Databases {
+		if database.Status == ManifestStatusSuccess {
+			succeeded++
+		}
+	}
+
+	return succeeded
+}
+
+// Summary returns the outcome of the database backup described by the written manifest
+func (m *Manifest) Summary() DatabaseSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	summary := DatabaseSummary{
+		Database: m.Database,
+		Status:   m.Status,
+		Files:    len(m.Files),
+		Duration: m.FinishedAt.Sub(m.StartedAt).Seconds(),
+	}
+
+	for _, file := range m.Files {
+		summary.Size += file.Size
+	}
+
+	return summary
+}
+
+// Finish completes the summary with the errors of the run
+func (s *RunSummary) Finish(errs []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.FinishedAt = time.Now()
+	s.Duration = s.FinishedAt.Sub(s.StartedAt).Seconds()
+
+	s.Status = ManifestStatusSuccess
+	if len(errs) > 0 {
+		s.Status = ManifestStatusFailed
+	}
+
+	for _, err := range errs {
+		s.Errors = append(s.Errors, err.Error())
+	}
+
+	s.Size = 0
+	for _, database := range s.Databases {
+		s.Size += database.Size
+	}
+
+	sort.Slice(s.Databases, func(i, j int) bool { return s.Databases[i].Database < s.Databases[j].Database })
+}
+
+// Title is the one line description of the run, used as Slack message and email subject
+func (s *RunSummary) Title() string {
+	name := s.HostName
+	if s.Profile != "" {
+		name = s.Profile + " (" + s.HostName + ")"
+	}
+
+	failed := 0
+	for _, database := range s.Databases {
+		if database.Status != ManifestStatusSuccess {
+			failed++
+		}
+	}
+
+	if s.Status == ManifestStatusSuccess {
+		return fmt.Sprintf("Backup of %s succeeded: %d databases, %s in %s", name, len(s.Databases), formatBytes(s.Size), formatSeconds(s.Duration))
+	}
+
+	return fmt.Sprintf("Backup of %s FAILED: %d of %d databases failed, %d errors, in %s", name, failed, len(s.Databases), len(s.Errors), formatSeconds(s.Duration))
+}
+
+// Text is the full description of the run
+func (s *RunSummary) Text() string {
+	var text strings.Builder
+
+	text.WriteString(s.Title() + "\n\n")
+
+	for _, database := range s.Databases {
+		if database.Status == ManifestStatusSuccess {
+			fmt.Fprintf(&text, "OK      %s : %d files, %s in %s\n", database.Database, database.Files, formatBytes(database.Size), formatSeconds(database.Duration))
+		} else {
+			fmt.Fprintf(&text, "FAILED  %s\n", database.Database)
+		}
+	}
+
+	if len(s.Errors) > 0 {
+		text.WriteString("\nErrors:\n")
+		for _, err := range s.Errors {
+			text.WriteString(err + "\n")
+		}
+	}
+
+	return text.String()
+}
+
+// formatBytes returns size in a human readable unit
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// formatSeconds returns a duration in seconds rounded to the second
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// Notify sends summary to every notifier configured in options. Failing notifiers only print a warning.
+func Notify(options Options, summary *RunSummary) {
+	if options.NotifyOn == NotifyFailure && summary.Status == ManifestStatusSuccess {
+		return
+	}
+
+	if options.NotifyWebhook != "" {
+		if err := postJSON(options.NotifyWebhook, summary); err != nil {
+			printMessage("error to send webhook notification: "+err.Error(), options.Verbosity, Warning)
+		}
+	}
+
+	if options.NotifySlack != "" {
+		if err := postJSON(options.NotifySlack, map[string]string{"text": "```" + summary.Text() + "```"}); err != nil {
+			printMessage("error to send Slack notification: "+err.Error(), options.Verbosity, Warning)
+		}
+	}
+
+	if options.NotifySMTP != "" {
+		if err := sendMail(options, summary); err != nil {
+			printMessage("error to send email notification: "+err.Error(), options.Verbosity, Warning)
+		}
+	}
+}
+
+// postJSON sends payload as JSON to url and checks the response status
+func postJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", url, response.Status)
+	}
+
+	return nil
+}
+
+// sendMail emails summary through the SMTP server of options, authenticating when MARS_SMTP_USERNAME is set
+func sendMail(options Options, summary *RunSummary) error {
+	if options.NotifyEmailFrom == "" || options.NotifyEmailTo == "" {
+		return fmt.Errorf("notify-email-from and notify-email-to are required")
+	}
+
+	var to []string
+	for _, address := range strings.Split(options.NotifyEmailTo, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			to = append(to, address)
+		}
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv(SMTPUsernameEnv); username != "" {
+		host, _, err := net.SplitHostPort(options.NotifySMTP)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", username, os.Getenv(SMTPPasswordEnv), host)
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", options.NotifyEmailFrom)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", summary.Title())
+	fmt.Fprintf(&message, "Date: %s\r\n", summary.FinishedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(summary.Text(), "\n", "\r\n", -1))
+
+	return smtp.SendMail(options.NotifySMTP, auth, options.NotifyEmailFrom, to, message.Bytes())
+}
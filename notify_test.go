@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSMTP is an SMTP stand-in accepting every command and recording the envelope and the data of each message
+type fakeSMTP struct {
+	listener net.Listener
+	messages chan smtpMessage
+}
+
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	f := &fakeSMTP{listener: listener, messages: make(chan smtpMessage, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake smtp")
+
+	var message smtpMessage
+	var data strings.Builder
+	indata := false
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		if indata {
+			if line == ".\r\n" {
+				indata = false
+				message.Data = data.String()
+				f.messages <- message
+				reply("250 queued")
+				continue
+			}
+			data.WriteString(line)
+			continue
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message = smtpMessage{From: strings.Trim(strings.TrimSpace(line)[len("MAIL FROM:"):], "<>")}
+			data.Reset()
+			reply("250 ok")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			message.To = append(message.To, strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>"))
+			reply("250 ok")
+		case command == "DATA":
+			indata = true
+			reply("354 end with .")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// webhookRecorder is an HTTP stand-in recording the JSON bodies it receives and answering status
+type webhookRecorder struct {
+	mu     sync.Mutex
+	bodies []string
+	status int
+}
+
+func (w *webhookRecorder) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bodies = append(w.bodies, string(body))
+
+	if w.status != 0 {
+		response.WriteHeader(w.status)
+	}
+}
+
+func testSummary(options Options, errs ...error) *RunSummary {
+	summary := NewRunSummary(options)
+	summary.AddDatabase(DatabaseSummary{Database: "shop", Status: ManifestStatusSuccess, Files: 3, Size: 5 << 20, Duration: 61})
+	if len(errs) > 0 {
+		summary.AddDatabase(DatabaseSummary{Database: "billing", Status: ManifestStatusFailed})
+	}
+	summary.Finish(errs)
+	return summary
+}
+
+func TestNotifyWebhooks(t *testing.T) {
+	webhook, slack := &webhookRecorder{}, &webhookRecorder{}
+	webhookServer, slackServer := httptest.NewServer(webhook), httptest.NewServer(slack)
+	defer webhookServer.Close()
+	defer slackServer.Close()
+
+	options := Options{Profile: "production", NotifyOn: NotifyAlways, NotifyWebhook: webhookServer.URL, NotifySlack: slackServer.URL}
+	options.HostName = "db1"
+
+	Notify(options, testSummary(options, errors.New("billing: connection refused")))
+
+	if len(webhook.bodies) != 1 {
+		t.Fatalf("webhook received %d requests, want 1", len(webhook.bodies))
+	}
+
+	var received RunSummary
+	if err := json.Unmarshal([]byte(webhook.bodies[0]), &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Profile != "production" || received.HostName != "db1" || received.Status != ManifestStatusFailed {
+		t.Errorf("webhook summary profile %q, host %q, status %q", received.Profile, received.HostName, received.Status)
+	}
+	if len(received.Databases) != 2 || received.Databases[0].Database != "billing" || received.Size != 5<<20 {
+		t.Errorf("webhook databases = %+v, size %d", received.Databases, received.Size)
+	}
+	if len(received.Errors) != 1 || received.Errors[0] != "billing: connection refused" {
+		t.Errorf("webhook errors = %v", received.Errors)
+	}
+
+	if len(slack.bodies) != 1 {
+		t.Fatalf("slack received %d requests, want 1", len(slack.bodies))
+	}
+
+	var message map[string]string
+	if err := json.Unmarshal([]byte(slack.bodies[0]), &message); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Backup of production (db1) FAILED", "FAILED  billing", "OK      shop : 3 files, 5.0 MiB in 1m1s"} {
+		if !strings.Contains(message["text"], want) {
+			t.Errorf("slack text %q does not contain %q", message["text"], want)
+		}
+	}
+}
+
+func TestNotifyOnFailure(t *testing.T) {
+	webhook := &webhookRecorder{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	options := Options{NotifyOn: NotifyFailure, NotifyWebhook: server.URL}
+
+	Notify(options, testSummary(options))
+	if len(webhook.bodies) != 0 {
+		t.Errorf("successful run notified with -notify-on failure")
+	}
+
+	Notify(options, testSummary(options, errors.New("billing: failed")))
+	if len(webhook.bodies) != 1 {
+		t.Errorf("failed run sent %d notifications, want 1", len(webhook.bodies))
+	}
+}
+
+func TestPostJSONStatus(t *testing.T) {
+	webhook := &webhookRecorder{status: http.StatusInternalServerError}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	if err := postJSON(server.URL, map[string]string{"text": "x"}); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("postJSON to a failing webhook = %v, want a 500 error", err)
+	}
+}
+
+func TestNotifySMTP(t *testing.T) {
+	server := startFakeSMTP(t)
+
+	options := Options{
+		Profile:         "production",
+		NotifyOn:        NotifyAlways,
+		NotifySMTP:      server.listener.Addr().String(),
+		NotifyEmailFrom: "mars@example.com",
+		NotifyEmailTo:   "dba@example.com, oncall@example.com",
+	}
+	options.HostName = "db1"
+
+	Notify(options, testSummary(options))
+
+	message := <-server.messages
+	if message.From != "mars@example.com" {
+		t.Errorf("MAIL FROM = %s", message.From)
+	}
+	if strings.Join(message.To, " ") != "dba@example.com oncall@example.com" {
+		t.Errorf("RCPT TO = %v", message.To)
+	}
+	for _, want := range []string{
+		"Subject: Backup of production (db1) succeeded: 1 databases, 5.0 MiB in 0s\r\n",
+		"To: dba@example.com, oncall@example.com\r\n",
+		"OK      shop : 3 files, 5.0 MiB in 1m1s\r\n",
+	} {
+		if !strings.Contains(message.Data, want) {
+			t.Errorf("email %q does not contain %q", message.Data, want)
+		}
+	}
+}
+
+func TestSendMailRequiresAddresses(t *testing.T) {
+	options := Options{NotifySMTP: "127.0.0.1:25", NotifyEmailFrom: "mars@example.com"}
+
+	if err := sendMail(options, testSummary(options)); err == nil {
+		t.Errorf("sendMail without recipients succeeded")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1024:            "1.0 KiB",
+		5 << 20:         "5.0 MiB",
+		3<<30 + 512<<20: "3.5 GiB",
+	}
+
+	for size, want := range tests {
+		if got := formatBytes(size); got != want {
+			t.Errorf("formatBytes(%d) = %s, want %s", size, got, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BackupJob model for one dump file to produce, the unit of work of the worker pool
+type BackupJob struct {
+	Database    string
+	Description string
+	Run         func() error
+
+	groups []*jobGroup
+}
+
+// jobGroup calls done once every job of the group has finished, e.g. all chunks of a table
+type jobGroup struct {
+	mu        sync.Mutex
+	remaining int
+	failed    bool
+	done      func(failed bool)
+}
+
+// Scheduler hands out jobs in order while keeping at most perDatabase jobs of a database running
+type Scheduler struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	pending     []BackupJob
+	running     map[string]int
+	perDatabase int
+}
+
+func newJobGroup(done func(failed bool)) *jobGroup {
+	return &jobGroup{done: done}
+}
+
+func (g *jobGroup) finish(err error) {
+	g.mu.Lock()
+	g.remaining--
+	if err != nil {
+		g.failed = true
+	}
+	remaining, failed := g.remaining, g.failed
+	g.mu.Unlock()
+
+	if remaining == 0 && g.done != nil {
+		g.done(failed)
+	}
+}
+
+// newBackupJob returns a new BackupJob instance and registers it in groups
+func newBackupJob(database string, description string, run func() error, groups ...*jobGroup) BackupJob {
+	for _, group := range groups {
+		group.mu.Lock()
+		group.remaining++
+		group.mu.Unlock()
+	}
+
+	return BackupJob{
+		Database:    database,
+		Description: description,
+		Run:         run,
+		groups:      groups,
+	}
+}
+
+// NewScheduler returns a new Scheduler instance, perDatabase <= 0 means no limit per database
+func NewScheduler(jobs []BackupJob, perDatabase int) *Scheduler {
+	s := &Scheduler{
+		pending:     append([]BackupJob(nil), jobs...),
+		running:     map[string]int{},
+		perDatabase: perDatabase,
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// Next blocks until a job can be started and returns it, ok is false once every job has been handed out
+func (s *Scheduler) Next() (job BackupJob, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.pending) > 0 {
+		for i, job := range s.pending {
+			if s.perDatabase <= 0 || s.running[job.Database] < s.perDatabase {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				s.running[job.Database]++
+				return job, true
+			}
+		}
+
+		s.cond.Wait()
+	}
+
+	return BackupJob{}, false
+}
+
+// Done releases the database slot taken by job
+func (s *Scheduler) Done(job BackupJob) {
+	s.mu.Lock()
+	s.running[job.Database]--
+	s.mu.Unlock()
+
+	s.cond.Broadcast()
+}
+
+// RunBackupJobs runs jobs on options.Parallel workers and returns the errors of the failed ones
+func RunBackupJobs(options Options, jobs []BackupJob) []error {
+	workers := options.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+
+	scheduler := NewScheduler(jobs, options.ParallelPerDatabase)
+
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				job, ok := scheduler.Next()
+				if !ok {
+					return
+				}
+
+				err := job.Run()
+				scheduler.Done(job)
+
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %v", job.Description, err))
+					mu.Unlock()
+				}
+
+				for _, group := range job.groups {
+					group.finish(err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errs
+}
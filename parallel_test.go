@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJobs returns one job per database of databases, described as the database and its index in the database
+func testJobs(databases ...string) []BackupJob {
+	var jobs []BackupJob
+	count := map[string]int{}
+	for _, database := range databases {
+		count[database]++
+		jobs = append(jobs, newBackupJob(database, fmt.Sprintf("%s%d", database, count[database]), func() error { return nil }))
+	}
+	return jobs
+}
+
+// startNext calls Next of scheduler in the background, the channel receives the job handed out
+func startNext(t *testing.T, scheduler *Scheduler) chan BackupJob {
+	t.Helper()
+
+	next := make(chan BackupJob, 1)
+	go func() {
+		if job, ok := scheduler.Next(); ok {
+			next <- job
+		}
+	}()
+
+	return next
+}
+
+// receiveJob returns the description of the job received from next, empty when Next is still blocked
+func receiveJob(next chan BackupJob) (string, BackupJob) {
+	select {
+	case job := <-next:
+		return job.Description, job
+	case <-time.After(50 * time.Millisecond):
+		return "", BackupJob{}
+	}
+}
+
+// unblockScheduler ends the calls to Next still blocked once the test is done
+func unblockScheduler(t *testing.T, scheduler *Scheduler) {
+	t.Cleanup(func() {
+		scheduler.mu.Lock()
+		scheduler.pending = nil
+		scheduler.mu.Unlock()
+		scheduler.cond.Broadcast()
+	})
+}
+
+func TestSchedulerNext(t *testing.T) {
+	tests := []struct {
+		name        string
+		databases   []string
+		perDatabase int
+		want        []string
+	}{
+		{"no limit", []string{"shop", "shop", "blog"}, 0, []string{"shop1", "shop2", "blog1"}},
+		{"one per database", []string{"shop", "shop", "shop", "blog", "crm"}, 1, []string{"shop1", "blog1", "crm1", ""}},
+		{"two per database", []string{"shop", "shop", "shop", "blog", "blog", "blog"}, 2, []string{"shop1", "shop2", "blog1", "blog2", ""}},
+		{"later database not blocked by a capped one", []string{"shop", "shop", "shop", "shop", "blog"}, 1, []string{"shop1", "blog1", ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheduler := NewScheduler(testJobs(test.databases...), test.perDatabase)
+			unblockScheduler(t, scheduler)
+
+			var got []string
+			for range test.want {
+				description, _ := receiveJob(startNext(t, scheduler))
+				got = append(got, description)
+				if description == "" {
+					break
+				}
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Next handed out %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerDone(t *testing.T) {
+	scheduler := NewScheduler(testJobs("shop", "shop", "blog", "blog"), 1)
+	unblockScheduler(t, scheduler)
+
+	_, shop1 := receiveJob(startNext(t, scheduler))
+	_, blog1 := receiveJob(startNext(t, scheduler))
+
+	next := startNext(t, scheduler)
+	if description, _ := receiveJob(next); description != "" {
+		t.Fatalf("Next handed out %s while both databases are at their limit", description)
+	}
+	scheduler.Done(blog1)
+	if description, _ := receiveJob(next); description != "blog2" {
+		t.Errorf("Next after blog1 is done = %q, want blog2", description)
+	}
+
+	next = startNext(t, scheduler)
+	if description, _ := receiveJob(next); description != "" {
+		t.Fatalf("Next handed out %s while both databases are at their limit", description)
+	}
+	scheduler.Done(shop1)
+	if description, _ := receiveJob(next); description != "shop2" {
+		t.Errorf("Next after shop1 is done = %q, want shop2", description)
+	}
+
+	if job, ok := scheduler.Next(); ok {
+		t.Errorf("Next handed out %s once every job was handed out", job.Description)
+	}
+}
+
+func TestRunBackupJobsPerDatabaseLimit(t *testing.T) {
+	tests := []struct {
+		parallel    int
+		perDatabase int
+		wantMax     int
+	}{
+		{parallel: 8, perDatabase: 2, wantMax: 2},
+		{parallel: 8, perDatabase: 1, wantMax: 1},
+		{parallel: 2, perDatabase: 0, wantMax: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("parallel %d per database %d", test.parallel, test.perDatabase), func(t *testing.T) {
+			var mu sync.Mutex
+			running, highest := map[string]int{}, map[string]int{}
+			total, highestTotal := 0, 0
+
+			var jobs []BackupJob
+			for _, database := range []string{"shop", "blog", "crm"} {
+				database := database
+				for i := 0; i < 6; i++ {
+					jobs = append(jobs, newBackupJob(database, database, func() error {
+						mu.Lock()
+						running[database]++
+						total++
+						if running[database] > highest[database] {
+							highest[database] = running[database]
+						}
+						if total > highestTotal {
+							highestTotal = total
+						}
+						mu.Unlock()
+
+						time.Sleep(5 * time.Millisecond)
+
+						mu.Lock()
+						running[database]--
+						total--
+						mu.Unlock()
+						return nil
+					}))
+				}
+			}
+
+			if errs := RunBackupJobs(Options{Parallel: test.parallel, ParallelPerDatabase: test.perDatabase}, jobs); len(errs) != 0 {
+				t.Fatal(errs)
+			}
+
+			for database, max := range highest {
+				if max > test.wantMax {
+					t.Errorf("%d jobs of %s ran at once, want at most %d", max, database, test.wantMax)
+				}
+			}
+			if highestTotal > test.parallel {
+				t.Errorf("%d jobs ran at once, want at most %d", highestTotal, test.parallel)
+			}
+		})
+	}
+}
+
+func TestJobGroupDone(t *testing.T) {
+	tests := []struct {
+		name       string
+		fail       map[int]bool
+		wantFailed bool
+	}{
+		{name: "every job succeeds"},
+		{name: "one job fails", fail: map[int]bool{1: true}, wantFailed: true},
+		{name: "every job fails", fail: map[int]bool{0: true, 1: true, 2: true, 3: true}, wantFailed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := map[string][]bool{}
+			done := func(name string) func(failed bool) {
+				return func(failed bool) {
+					mu.Lock()
+					calls[name] = append(calls[name], failed)
+					mu.Unlock()
+				}
+			}
+
+			database := newJobGroup(done("database"))
+			table := newJobGroup(done("table"))
+
+			var jobs []BackupJob
+			for i := 0; i < 4; i++ {
+				err := error(nil)
+				if test.fail[i] {
+					err = errors.New("lost connection")
+				}
+				jobs = append(jobs, newBackupJob("shop", fmt.Sprintf("chunk %d", i), func() error { return err }, table, database))
+			}
+			jobs = append(jobs, newBackupJob("shop", "schema", func() error { return nil }, database))
+
+			errs := RunBackupJobs(Options{Parallel: 3}, jobs)
+			if len(errs) != len(test.fail) {
+				t.Errorf("RunBackupJobs returned %d errors, want %d", len(errs), len(test.fail))
+			}
+
+			want := map[string][]bool{"database": {test.wantFailed}, "table": {test.wantFailed}}
+			if !reflect.DeepEqual(calls, want) {
+				t.Errorf("done calls = %v, want %v", calls, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// Formats of the prune report
+const (
+	// PruneReportTable prints one aligned line per backup directory
+	PruneReportTable = "table"
+
+	// PruneReportJSON prints the decisions as a JSON array
+	PruneReportJSON = "json"
+)
+
+// PruneReportLine model for one backup directory of the prune report
+type PruneReportLine struct {
+	Profile string
+	RetentionDecision
+}
+
+// definePruneFlags adds the flags of mars prune to flags
+func definePruneFlags(flags *flag.FlagSet, dryrun *bool, report *string) {
+	flags.BoolVar(dryrun, "dry-run", false, "Only print the backup directories that would be kept or removed, and why")
+	flags.StringVar(report, "report", PruneReportTable, "Format of the report: table or json")
+}
+
+// GetPruneOptions creates the Options of each profile of mars prune from Commandline arguments, with the dry-run and report flags
+func GetPruneOptions(arguments []string) ([]*Options, bool, string) {
+	var dryrun bool
+	var report string
+	definePruneFlags(flag.CommandLine, &dryrun, &report)
+
+	return parseOptions(arguments, true), dryrun, report
+}
+
+// applyRetention logs why each backup directory is kept or removed and, unless dryrun, removes the expired ones.
+// It returns the number of directories that could not be removed.
+func applyRetention(options Options, storage Storage, decisions []RetentionDecision, dryrun bool) int {
+	failed := 0
+
+	for _, decision := range decisions {
+		fields := LogFields{"file": decision.Path, "tier": decision.Tier, "reason": decision.Reason}
+
+		if decision.Keep {
+			printEvent("Keeping backup : "+decision.Path+", "+decision.Reason, options.Verbosity, Info, fields)
+			continue
+		}
+
+		if dryrun {
+			printEvent("Would remove expired backup : "+decision.Path+", "+decision.Reason, options.Verbosity, Info, fields)
+			continue
+		}
+
+		printEvent("Removing expired backup : "+decision.Path+", "+decision.Reason, options.Verbosity, Info, fields)
+		if err := DeleteStorageDir(storage, decision.Path); err != nil {
+			printMessage("error to remove "+decision.Path+": "+err.Error(), options.Verbosity, Error)
+			failed++
+			continue
+		}
+		recordRotationDeletion(options, decision.Tier)
+	}
+
+	return failed
+}
+
+// Prune applies the retention policy and quota of every profile without running a backup, or with dryrun only reports them.
+// It prints the report in the report format and returns the process exit code.
+func Prune(allOptions []*Options, dryrun bool, report string) int {
+	verbosity := allOptions[len(allOptions)-1].Verbosity
+
+	if report != PruneReportTable && report != PruneReportJSON {
+		printMessage("report must be either "+PruneReportTable+" or "+PruneReportJSON, verbosity, Error)
+		return 1
+	}
+
+	var lines []PruneReportLine
+	failed := 0
+
+	for _, options := range allOptions {
+		storage, err := NewStorage(*options)
+		if err != nil {
+			printMessage("error to open storage: "+err.Error(), options.Verbosity, Error)
+			failed++
+			continue
+		}
+
+		dirs, err := listBackupDirs(*options, storage)
+		if err != nil {
+			printMessage("error to list backups: "+err.Error(), options.Verbosity, Error)
+			failed++
+			continue
+		}
+
+		databases, err := listDatabaseDirs(storage)
+		if err != nil {
+			printMessage("error to list backups: "+err.Error(), options.Verbosity, Error)
+			failed++
+			continue
+		}
+
+		protected, err := protectedBackups(storage, databases)
+		if err != nil {
+			printMessage("error to list backups: "+err.Error(), options.Verbosity, Error)
+			failed++
+			continue
+		}
+
+		decisions := PlanRetention(dirs, NewRetentionPolicy(*options), protected)
+		failed += applyRetention(*options, storage, decisions, dryrun)
+
+		// the quota is computed without the directories the rotation removes
+		removed := map[string]bool{}
+		for _, decision := range decisions {
+			removed[decision.Path] = !decision.Keep
+		}
+		quota, quotafailed := applyQuota(*options, storage, removed, dryrun)
+		decisions = append(decisions, quota...)
+		failed += quotafailed
+
+		for _, decision := range decisions {
+			lines = append(lines, PruneReportLine{Profile: options.Profile, RetentionDecision: decision})
+		}
+	}
+
+	if report == PruneReportJSON {
+		output, _ := json.MarshalIndent(lines, "", "\t")
+		fmt.Println(string(output))
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "PROFILE\tTIER\tDIRECTORY\tACTION\tREASON")
+		for _, line := range lines {
+			action := "keep"
+			if !line.Keep && dryrun {
+				action = "would remove"
+			} else if !line.Keep {
+				action = "remove"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", line.Profile, line.Tier, line.Path, action, line.Reason)
+		}
+		writer.Flush()
+	}
+
+	if failed > 0 {
+		return 4
+	}
+
+	return 0
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QuotaPolicy model for the size limits of the backups, a limit at 0 is disabled
+type QuotaPolicy struct {
+	// MaxTotalSize is the maximum size of every backup of every tier
+	MaxTotalSize int64
+
+	// MinFreeSpace is the free space kept on the filesystem of the output directory
+	MinFreeSpace int64
+}
+
+// quotaDir model for one database directory of a backup, e.g. daily/2017-08-05/shop-2017-08-05
+type quotaDir struct {
+	BackupDir
+	Database string
+	Success  bool
+	Files    []StorageObject
+}
+
+// ParseSize returns the bytes of value, a number with an optional K, M, G or T binary unit, e.g. 500G or 1.5T
+func ParseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	if number == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	if i := strings.IndexAny(number, "KMGT"); i >= 0 && i == len(number)-1 {
+		multiplier = int64(1) << (10 * uint(strings.IndexByte("KMGT", number[i])+1))
+		number = number[:i]
+	}
+
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q, e.g. 500G or 1.5T", value)
+	}
+
+	return int64(size * float64(multiplier)), nil
+}
+
+// NewQuotaPolicy returns the policy of the -max-total-size and -min-free-space options
+func NewQuotaPolicy(options Options) QuotaPolicy {
+	return QuotaPolicy{MaxTotalSize: options.MaxTotalSize, MinFreeSpace: options.MinFreeSpace}
+}
+
+// storageFreeSpace returns the free space of the filesystem of storage, -1 when it is unknown
+func storageFreeSpace(storage Storage) int64 {
+	local, ok := storage.(*LocalStorage)
+	if !ok {
+		return -1
+	}
+
+	free, err := diskFree(local.Root)
+	if err != nil {
+		return -1
+	}
+
+	return free
+}
+
+// listQuotaDirs returns the database directories of every tier in storage with their files and manifest status,
+// leaving out those below the excluded backup directories
+func listQuotaDirs(storage Storage, excluded map[string]bool) ([]quotaDir, error) {
+	var dirs []quotaDir
+
+	for _, tier := range RetentionTiers {
+		objects, err := storage.List(tier.Name + "/")
+		if err != nil {
+			return nil, fmt.Errorf("list %s backups in %s: %v", tier.Name, storage.String(), err)
+		}
+
+		index := map[string]int{}
+		for _, object := range objects {
+			parts := strings.SplitN(object.Key, "/", 4)
+			if len(parts) < 4 || excluded[parts[0]+"/"+parts[1]] {
+				continue
+			}
+
+			backup, ok := ParseBackupDir(parts[0] + "/" + parts[1])
+			if !ok {
+				continue
+			}
+
+			p := path.Join(parts[0], parts[1], parts[2])
+			i, found := index[p]
+			if !found {
+				backup.Path = p
+				i = len(dirs)
+				index[p] = i
+				// hourly directories hold {DATABASE_NAME}-{DATE} directories too, without the hour
+				database := sourceDatabaseFromDir(parts[2])
+				if database == "" {
+					database = parts[2]
+				}
+				dirs = append(dirs, quotaDir{BackupDir: backup, Database: database})
+			}
+			dirs[i].Files = append(dirs[i].Files, object)
+		}
+	}
+
+	for i := range dirs {
+		success, err := readManifestSuccess(storage, dirs[i].Path)
+		if err != nil {
+			return nil, err
+		}
+		dirs[i].Success = success
+	}
+
+	return dirs, nil
+}
+
+// readManifestSuccess tells if the manifest of the database directory dir reports a successful backup.
+// Directories of older versions, without manifest, are taken as successful.
+func readManifestSuccess(storage Storage, dir string) (bool, error) {
+	status, err := storageManifestStatus(storage, dir)
+	if err != nil {
+		return false, err
+	}
+
+	return status == "" || status == ManifestStatusSuccess, nil
+}
+
+// storageManifestStatus returns the status of the manifest of the database directory dir in storage,
+// empty when dir has no manifest. A manifest that can not be decoded is reported as failed.
+func storageManifestStatus(storage Storage, dir string) (string, error) {
+	reader, err := storage.Get(dir + "/" + ManifestFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read manifest of %s: %v", dir, err)
+	}
+	defer reader.Close()
+
+	var manifest struct{ Status string }
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return ManifestStatusFailed, nil
+	}
+
+	return manifest.Status, nil
+}
+
+// PlanQuota returns the database directories to remove, oldest first, until the backups fit policy.
+// The bytes shared by hardlinks are counted once and freed with their last link: a directory whose files are
+// all linked from other directories is removed along with them, or kept when one of them is protected. free is the free
+// space of the filesystem, -1 when unknown. The newest successful backup of each database is never removed.
+// It also returns whether the backups fit policy once the directories are removed.
+func PlanQuota(dirs []quotaDir, policy QuotaPolicy, free int64) ([]RetentionDecision, bool) {
+	refs := map[string]int{}
+	sizes := map[string]int64{}
+	var used int64
+
+	id := func(object StorageObject) string {
+		if object.ID != "" {
+			return object.ID
+		}
+		return "key:" + object.Key
+	}
+
+	for _, dir := range dirs {
+		for _, object := range dir.Files {
+			if refs[id(object)] == 0 {
+				sizes[id(object)] = object.Size
+				used += object.Size
+			}
+			refs[id(object)]++
+		}
+	}
+
+	tierOrder := map[string]int{}
+	for i, tier := range RetentionTiers {
+		tierOrder[tier.Name] = i
+	}
+
+	var databases []DatabaseDir
+	success := map[string]bool{}
+	for _, dir := range dirs {
+		databases = append(databases, DatabaseDir{BackupDir: dir.BackupDir, Database: dir.Database})
+		success[dir.Path] = dir.Success
+	}
+	protected := newestSuccessfulBackups(databases, success)
+
+	fits := func() bool {
+		if policy.MaxTotalSize > 0 && used > policy.MaxTotalSize {
+			return false
+		}
+		if policy.MinFreeSpace > 0 && free >= 0 && free < policy.MinFreeSpace {
+			return false
+		}
+		return true
+	}
+
+	candidates := append([]quotaDir(nil), dirs...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if !candidates[i].Date.Equal(candidates[j].Date) {
+			return candidates[i].Date.Before(candidates[j].Date)
+		}
+		return tierOrder[candidates[i].Tier] < tierOrder[candidates[j].Tier]
+	})
+
+	holders := map[string][]quotaDir{}
+	for _, dir := range dirs {
+		for _, object := range dir.Files {
+			holders[id(object)] = append(holders[id(object)], dir)
+		}
+	}
+	removed := map[string]bool{}
+
+	// freed returns the bytes removing group frees, those of the files not linked from a directory outside of it
+	freed := func(group []quotaDir) int64 {
+		links := map[string]int{}
+		for _, dir := range group {
+			for _, object := range dir.Files {
+				links[id(object)]++
+			}
+		}
+
+		var bytes int64
+		for object, count := range links {
+			if refs[object] == count {
+				bytes += sizes[object]
+			}
+		}
+		return bytes
+	}
+
+	// linked returns dir and the directories still kept, not protected, sharing a file with it or with one of them
+	linked := func(dir quotaDir) []quotaDir {
+		group := []quotaDir{dir}
+		seen := map[string]bool{dir.Path: true}
+		for i := 0; i < len(group); i++ {
+			for _, object := range group[i].Files {
+				for _, other := range holders[id(object)] {
+					if !seen[other.Path] && !removed[other.Path] && protected[other.Database] != other.Path {
+						seen[other.Path] = true
+						group = append(group, other)
+					}
+				}
+			}
+		}
+		return group
+	}
+
+	var decisions []RetentionDecision
+	for _, dir := range candidates {
+		if fits() {
+			break
+		}
+
+		if removed[dir.Path] || protected[dir.Database] == dir.Path {
+			continue
+		}
+
+		// the files of a promoted backup are hardlinks of the backup of another tier, they are only freed
+		// along with it; a directory linked to a protected backup frees nothing and is kept
+		group := []quotaDir{dir}
+		if freed(group) == 0 {
+			group = linked(dir)
+			if freed(group) == 0 {
+				continue
+			}
+		}
+
+		reason := fmt.Sprintf("quota: %s used", formatBytes(used))
+		if policy.MaxTotalSize > 0 {
+			reason += " of -max-total-size " + formatBytes(policy.MaxTotalSize)
+		}
+		if policy.MinFreeSpace > 0 && free >= 0 {
+			reason += fmt.Sprintf(", %s free of -min-free-space %s", formatBytes(free), formatBytes(policy.MinFreeSpace))
+		}
+
+		for i, member := range group {
+			for _, object := range member.Files {
+				refs[id(object)]--
+				if refs[id(object)] == 0 {
+					used -= sizes[id(object)]
+					if free >= 0 {
+						free += sizes[id(object)]
+					}
+				}
+			}
+			removed[member.Path] = true
+
+			memberReason := reason
+			if i > 0 {
+				memberReason += ", hardlinked to " + dir.Path
+			}
+			decisions = append(decisions, RetentionDecision{BackupDir: member.BackupDir, Reason: memberReason})
+		}
+	}
+
+	return decisions, fits()
+}
+
+// applyQuota removes the oldest backups until the backups of storage fit the quota of options,
+// or with dryrun only logs them. excluded are the backup directories already removed by the rotation.
+// It returns the decisions and the number of directories that could not be removed.
+func applyQuota(options Options, storage Storage, excluded map[string]bool, dryrun bool) ([]RetentionDecision, int) {
+	policy := NewQuotaPolicy(options)
+	if policy.MaxTotalSize <= 0 && policy.MinFreeSpace <= 0 {
+		return nil, 0
+	}
+
+	free := storageFreeSpace(storage)
+	if policy.MinFreeSpace > 0 && free < 0 {
+		printMessage("-min-free-space only applies to a local output-dir, ignoring it for "+storage.String(), options.Verbosity, Warning)
+	}
+
+	dirs, err := listQuotaDirs(storage, excluded)
+	if err != nil {
+		printMessage("error to apply the quota: "+err.Error(), options.Verbosity, Error)
+		return nil, 1
+	}
+
+	decisions, fits := PlanQuota(dirs, policy, free)
+	failed := applyRetention(options, storage, decisions, dryrun)
+
+	if !fits {
+		printMessage("The backups still exceed the quota, the newest successful backup of each database is never removed", options.Verbosity, Warning)
+	}
+
+	return decisions, failed
+}
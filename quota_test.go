@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// unreadableStorage fails every Get with an error other than not found
+type unreadableStorage struct {
+	*LocalStorage
+}
+
+func (unreadableStorage) Get(key string) (io.ReadCloser, error) {
+	return nil, errors.New("connection reset by peer")
+}
+
+func TestReadManifestSuccess(t *testing.T) {
+	const dir = "daily/2017-08-05/shop-2017-08-05"
+
+	tests := []struct {
+		name        string
+		manifest    string
+		unreadable  bool
+		wantStatus  string
+		wantSuccess bool
+		wantErr     bool
+	}{
+		{name: "successful backup", manifest: `{"Status": "success"}`, wantStatus: ManifestStatusSuccess, wantSuccess: true},
+		{name: "failed backup", manifest: `{"Status": "failed"}`, wantStatus: ManifestStatusFailed},
+		{name: "corrupt manifest", manifest: `{"Status": `, wantStatus: ManifestStatusFailed},
+		{name: "older version without manifest", wantSuccess: true},
+		{name: "unreadable storage", manifest: `{"Status": "success"}`, unreadable: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local := backupTree(t, dir)
+			if test.manifest != "" {
+				putString(t, local, dir+"/"+ManifestFilename, test.manifest)
+			}
+
+			var storage Storage = local
+			if test.unreadable {
+				storage = unreadableStorage{local}
+			}
+
+			status, err := storageManifestStatus(storage, dir)
+			if (err != nil) != test.wantErr || status != test.wantStatus {
+				t.Errorf("storageManifestStatus = %q, %v, want %q, error %t", status, err, test.wantStatus, test.wantErr)
+			}
+
+			success, err := readManifestSuccess(storage, dir)
+			if (err != nil) != test.wantErr || success != test.wantSuccess {
+				t.Errorf("readManifestSuccess = %t, %v, want %t, error %t", success, err, test.wantSuccess, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestListQuotaDirsDatabase(t *testing.T) {
+	storage := backupTree(t,
+		"daily/2017-08-05/shop-2017-08-05",
+		"daily/2017-08-05/my-shop-2017-08-05",
+		"hourly/2017-08-05-14/shop-2017-08-05",
+		"hourly/2017-08-05-14/my-shop-2017-08-05",
+		"weekly/2017-07-31/shop-2017-07-31",
+		"weekly/2017-07-31/legacy",
+	)
+
+	dirs, err := listQuotaDirs(storage, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, dir := range dirs {
+		got[dir.Path] = dir.Database
+	}
+
+	want := map[string]string{
+		"daily/2017-08-05/shop-2017-08-05":        "shop",
+		"daily/2017-08-05/my-shop-2017-08-05":     "my-shop",
+		"hourly/2017-08-05-14/shop-2017-08-05":    "shop",
+		"hourly/2017-08-05-14/my-shop-2017-08-05": "my-shop",
+		"weekly/2017-07-31/shop-2017-07-31":       "shop",
+		"weekly/2017-07-31/legacy":                "legacy",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("databases = %v, want %v", got, want)
+	}
+}
+
+func TestPlanQuotaKeepsNewestHourlyBackup(t *testing.T) {
+	storage := backupTree(t,
+		"daily/2017-08-04/shop-2017-08-04",
+		"daily/2017-08-05/shop-2017-08-05",
+		"hourly/2017-08-05-13/shop-2017-08-05",
+		"hourly/2017-08-05-14/shop-2017-08-05",
+	)
+
+	dirs, err := listQuotaDirs(storage, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decisions, fits := PlanQuota(dirs, QuotaPolicy{MaxTotalSize: 1}, -1)
+	if fits {
+		t.Errorf("backups fit a quota of 1 byte")
+	}
+
+	var removed []string
+	for _, decision := range decisions {
+		if !decision.Keep {
+			removed = append(removed, decision.Path)
+		}
+	}
+	sort.Strings(removed)
+
+	want := []string{
+		"daily/2017-08-04/shop-2017-08-04",
+		"daily/2017-08-05/shop-2017-08-05",
+		"hourly/2017-08-05-13/shop-2017-08-05",
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+}
+
+func TestPlanQuotaHardlinks(t *testing.T) {
+	storage := backupTree(t,
+		"daily/2017-08-04/shop-2017-08-04",
+		"daily/2017-08-05/shop-2017-08-05",
+	)
+	link := func(src string, dst string) {
+		t.Helper()
+		if _, err := storage.Link(src, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the weekly copy of the newest backup, and the monthly copy of the older one
+	link("daily/2017-08-05/shop-2017-08-05/shop_ALL.sql.gz", "weekly/2017-07-31/shop-2017-08-05/shop_ALL.sql.gz")
+	link("daily/2017-08-04/shop-2017-08-04/shop_ALL.sql.gz", "monthly/2017-08-04/shop-2017-08-04/shop_ALL.sql.gz")
+
+	dirs, err := listQuotaDirs(storage, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decisions, fits := PlanQuota(dirs, QuotaPolicy{MaxTotalSize: 1}, -1)
+	if fits {
+		t.Errorf("backups fit a quota of 1 byte")
+	}
+
+	var removed []string
+	for _, decision := range decisions {
+		removed = append(removed, decision.Path)
+	}
+	sort.Strings(removed)
+
+	// removing the weekly copy of the protected backup would free nothing
+	want := []string{
+		"daily/2017-08-04/shop-2017-08-04",
+		"monthly/2017-08-04/shop-2017-08-04",
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+}
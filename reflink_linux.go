@@ -0,0 +1,43 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, sharing the extents of a file with another on btrfs, xfs and other CoW filesystems
+const ficlone = 0x40049409
+
+// reflinkFile makes dst a copy-on-write clone of src, through a temporary file so dst is never seen half written
+func reflinkFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+		out.Close()
+		os.Remove(dst + ".tmp")
+		return errno
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+
+	return os.Rename(dst+".tmp", dst)
+}
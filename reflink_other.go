@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// reflinkFile is only supported on linux, elsewhere promotions fall back to a copy
+func reflinkFile(src string, dst string) error {
+	return errors.New("reflinks are not supported on this system")
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+var createTableRegexp = regexp.MustCompile("^CREATE TABLE `([^`]+)`")
+
+// RestoreOptions model for restore subcommand arguments
+type RestoreOptions struct {
+	Connection
+	Database       string
+	SourceDatabase string
+	From           string
+	MySQLPath      string
+	CreateDatabase bool
+	Identities     []age.Identity
+	Verbosity      int
+}
+
+// BackupFile model for one archive found in a backup directory
+type BackupFile struct {
+	Path  string
+	Kind  string
+	Table string
+	Index int
+}
+
+// GetRestoreOptions creates RestoreOptions type from the restore subcommand arguments
+func GetRestoreOptions(arguments []string) *RestoreOptions {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+
+	var connection Connection
+	flags.StringVar(&connection.HostName, "hostname", "localhost", "Hostname of the mysql server to restore to")
+
+	flags.StringVar(&connection.Bind, "bind", "3306", "Port of the mysql server to restore to")
+
+	flags.StringVar(&connection.UserName, "username", "root", "username of the mysql server to restore to")
+
+	flags.StringVar(&connection.Password, "password", "", "password of the mysql server to restore to. Visible to other users in ps, prefer the "+PasswordEnv+" environment variable or -password-command")
+
+	var passwordcommand string
+	flags.StringVar(&passwordcommand, "password-command", "", "Shell command printing the password of the mysql server to restore to")
+
+	defineConnectionFlags(flags, &connection)
+
+	var from string
+	flags.StringVar(&from, "from", "", "Backup directory to restore, e.g. output-dir/daily/{DATE}/{DATABASE_NAME}-{DATE}")
+
+	var database string
+	flags.StringVar(&database, "database", "", "Database to restore into")
+
+	var sourcedatabase string
+	flags.StringVar(&sourcedatabase, "source-database", "", "Database name used in the backup file names. Default is taken from the -from directory name")
+
+	var mysqlpath string
+	flags.StringVar(&mysqlpath, "mysql-path", "/usr/bin/mysql", "Absolute path for mysql client executable.")
+
+	var createdatabase bool
+	flags.BoolVar(&createdatabase, "create-database", true, "Create the database before restoring if it does not exist")
+
+	var identityfile string
+	flags.StringVar(&identityfile, "identity", "", "age identity file holding the private keys of encrypted backup files")
+
+	var passphrasefile string
+	flags.StringVar(&passphrasefile, "passphrase-file", "", "File holding the passphrase of encrypted backup files in its first line")
+
+	var verbosity int
+	flags.IntVar(&verbosity, "verbosity", 2, "0 = only errors, 1 = important things, 2 = all")
+
+	var logformat, logfile string
+	defineLogFlags(flags, &logformat, &logfile)
+
+	flags.Parse(arguments)
+
+	if err := SetupLogging(logformat, logfile); err != nil {
+		printMessage(err.Error(), verbosity, Error)
+		os.Exit(1)
+	}
+
+	if from == "" || database == "" {
+		printMessage("-from and -database parameters are required", verbosity, Error)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	if sourcedatabase == "" {
+		sourcedatabase = sourceDatabaseFromDir(from)
+		if sourcedatabase == "" {
+			sourcedatabase = database
+		}
+	}
+
+	if _, err := os.Stat(mysqlpath); os.IsNotExist(err) {
+		printMessage("mysql binary can not be found, please specify correct value for mysql-path parameter", verbosity, Error)
+		os.Exit(1)
+	}
+
+	if err := connection.Validate(); err != nil {
+		printMessage(err.Error(), verbosity, Error)
+		os.Exit(1)
+	}
+
+	var err error
+	if connection.Password, err = ResolvePassword(connection.Password, passwordcommand); err != nil {
+		printMessage(err.Error(), verbosity, Error)
+		os.Exit(1)
+	}
+
+	identities, err := LoadIdentities(identityfile, passphrasefile)
+	if err != nil {
+		printMessage("error to load decryption keys: "+err.Error(), verbosity, Error)
+		os.Exit(1)
+	}
+
+	return &RestoreOptions{
+		Connection:     connection,
+		Database:       database,
+		SourceDatabase: sourcedatabase,
+		From:           from,
+		MySQLPath:      mysqlpath,
+		CreateDatabase: createdatabase,
+		Identities:     identities,
+		Verbosity:      verbosity,
+	}
+}
+
+// Restore replays every archive of a backup directory, schema first, and returns the process exit code
+func Restore(options RestoreOptions) int {
+	printMessage("Restoring "+options.From+" into database : "+options.Database, options.Verbosity, Info)
+
+	if manifest, err := ReadManifest(options.From); err == nil && manifest.Status != ManifestStatusSuccess {
+		printMessage("the manifest marks this backup as "+manifest.Status+", it may be incomplete", options.Verbosity, Warning)
+	}
+
+	files, err := DiscoverBackupFiles(options.From, options.SourceDatabase, options.Identities)
+	if err != nil {
+		printMessage("error to read backup directory: "+err.Error(), options.Verbosity, Error)
+		return 4
+	}
+
+	if len(files) == 0 {
+		printMessage("no backup archives found for database "+options.SourceDatabase+" in "+options.From, options.Verbosity, Error)
+		return 4
+	}
+
+	if options.CreateDatabase {
+		if err := runMySQL(options, nil, "-e", "CREATE DATABASE IF NOT EXISTS "+quoteIdentifier(options.Database)); err != nil {
+			printMessage("error to create database "+options.Database+": "+err.Error(), options.Verbosity, Error)
+			return 4
+		}
+	}
+
+	applied := 0
+	for i, file := range files {
+		started := time.Now()
+		printMessage(fmt.Sprintf("[%d/%d] Restoring file : %s", i+1, len(files), file.Path), options.Verbosity, Info)
+
+		if err := restoreFile(options, file); err != nil {
+			printMessage(fmt.Sprintf("[%d/%d] FAILED : %s : %s", i+1, len(files), file.Path, err.Error()), options.Verbosity, Error)
+
+			for _, skipped := range files[i+1:] {
+				printMessage("SKIPPED : "+skipped.Path, options.Verbosity, Warning)
+			}
+			break
+		}
+
+		applied++
+		printMessage(fmt.Sprintf("[%d/%d] OK : %s (%s)", i+1, len(files), file.Path, time.Since(started)), options.Verbosity, Info)
+	}
+
+	if applied != len(files) {
+		printMessage(fmt.Sprintf("Restore failed : %d of %d files applied to %s", applied, len(files), options.Database), options.Verbosity, Error)
+		return 4
+	}
+
+	printMessage(fmt.Sprintf("Restore successfull : %d files applied to %s", applied, options.Database), options.Verbosity, Info)
+	return 0
+}
+
+// DiscoverBackupFiles lists the archives of database in dir in the order they have to be restored:
+// schema, whole database dumps, then table chunks ordered by table name and chunk index.
+// The manifest is used when the directory has one, file names are parsed otherwise,
+// in which case identities decrypt the schema archive to read its table names.
+func DiscoverBackupFiles(dir string, database string, identities []age.Identity) ([]BackupFile, error) {
+	if manifest, err := ReadManifest(dir); err == nil {
+		var files []BackupFile
+		for _, file := range manifest.Files {
+			files = append(files, BackupFile{Path: filepath.Join(dir, file.File), Kind: file.Kind, Table: file.Table, Index: file.Chunk})
+		}
+
+		sortBackupFiles(files)
+		return files, nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []BackupFile
+	var chunks []string
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, database+"_") || !IsArchive(name) {
+			continue
+		}
+
+		// {DATABASE_NAME}_{TABLENAME{INDEX}|SCHEMA|DATA|ALL}_{TIMESTAMP}.sql.gz
+		rest := strings.TrimPrefix(ArchiveBase(name), database+"_")
+		separator := strings.LastIndex(rest, "_")
+		if separator <= 0 {
+			continue
+		}
+		rest = rest[:separator]
+
+		switch rest {
+		case KindSchema, KindAll, KindData:
+			files = append(files, BackupFile{Path: filepath.Join(dir, name), Kind: rest})
+		default:
+			chunks = append(chunks, name)
+		}
+	}
+
+	var tables []string
+	for _, file := range files {
+		if file.Kind == KindSchema {
+			tables, err = schemaTableNames(file.Path, identities)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range chunks {
+		rest := strings.TrimPrefix(ArchiveBase(name), database+"_")
+		rest = rest[:strings.LastIndex(rest, "_")]
+
+		table, index, ok := splitTableChunk(rest, tables)
+		if !ok {
+			continue
+		}
+
+		files = append(files, BackupFile{Path: filepath.Join(dir, name), Kind: KindTable, Table: table, Index: index})
+	}
+
+	sortBackupFiles(files)
+	return files, nil
+}
+
+// sortBackupFiles puts files in restore order
+func sortBackupFiles(files []BackupFile) {
+	order := map[string]int{KindSchema: 0, KindAll: 1, KindData: 2, KindTable: 3}
+	sort.SliceStable(files, func(i, j int) bool {
+		if order[files[i].Kind] != order[files[j].Kind] {
+			return order[files[i].Kind] < order[files[j].Kind]
+		}
+		if files[i].Table != files[j].Table {
+			return files[i].Table < files[j].Table
+		}
+		return files[i].Index < files[j].Index
+	})
+}
+
+// splitTableChunk splits "{TABLENAME}{INDEX}" as written by generateTableBackup.
+// Table names known from the schema win, so tables ending with digits are not mistaken for chunk indexes.
+func splitTableChunk(name string, tables []string) (string, int, bool) {
+	table := ""
+	for _, t := range tables {
+		if len(t) > len(table) && strings.HasPrefix(name, t) {
+			if _, err := strconv.Atoi(name[len(t):]); err == nil {
+				table = t
+			}
+		}
+	}
+
+	if table == "" {
+		table = strings.TrimRight(name, "0123456789")
+	}
+
+	index, err := strconv.Atoi(name[len(table):])
+	if table == "" || err != nil {
+		return "", 0, false
+	}
+
+	return table, index, true
+}
+
+// schemaTableNames returns the tables created by a schema archive
+func schemaTableNames(filename string, identities []age.Identity) ([]string, error) {
+	reader, err := OpenArchive(filename, identities)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var tables []string
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if match := createTableRegexp.FindStringSubmatch(scanner.Text()); match != nil {
+			tables = append(tables, match[1])
+		}
+	}
+
+	return tables, scanner.Err()
+}
+
+// sourceDatabaseFromDir extracts {DATABASE_NAME} from a {DATABASE_NAME}-{DATE} backup directory
+func sourceDatabaseFromDir(dir string) string {
+	base := filepath.Base(filepath.Clean(dir))
+	if len(base) <= len("-2006-01-02") {
+		return ""
+	}
+
+	if _, err := time.Parse("2006-01-02", base[len(base)-len("2006-01-02"):]); err != nil {
+		return ""
+	}
+
+	return base[:len(base)-len("-2006-01-02")]
+}
+
+func restoreFile(options RestoreOptions, file BackupFile) error {
+	reader, err := OpenArchive(file.Path, options.Identities)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return runMySQL(options, reader, options.Database)
+}
+
+// runMySQL executes the mysql client against the restore target, feeding it stdin
+func runMySQL(options RestoreOptions, stdin io.Reader, arguments ...string) error {
+	optionFile, err := writeClientOptionFile(options.UserName, options.Password)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(optionFile)
+
+	var args []string
+	args = append(args, "--defaults-extra-file="+optionFile)
+	args = append(args, options.ClientArgs()...)
+	args = append(args, arguments...)
+
+	cmd := exec.Command(options.MySQLPath, args...)
+	cmd.Stdin = stdin
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
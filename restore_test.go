@@ -0,0 +1,173 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestSplitTableChunk(t *testing.T) {
+	tests := []struct {
+		name      string
+		tables    []string
+		wantTable string
+		wantIndex int
+		wantOK    bool
+	}{
+		{"orders1", []string{"orders"}, "orders", 1, true},
+		{"orders12", []string{"orders"}, "orders", 12, true},
+		{"orders12", nil, "orders", 12, true},
+		{"order_items3", []string{"order_items"}, "order_items", 3, true},
+		{"order_items3", nil, "order_items", 3, true},
+		// tables ending with digits are only split right when the schema names them
+		{"events20231", []string{"events2023"}, "events2023", 1, true},
+		{"events20231", []string{"events", "events2023"}, "events2023", 1, true},
+		{"events20231", nil, "events", 20231, true},
+		{"orders", []string{"orders"}, "", 0, false},
+		{"42", nil, "", 0, false},
+	}
+
+	for _, test := range tests {
+		table, index, ok := splitTableChunk(test.name, test.tables)
+		if table != test.wantTable || index != test.wantIndex || ok != test.wantOK {
+			t.Errorf("splitTableChunk(%q, %v) = %q, %d, %t, want %q, %d, %t", test.name, test.tables, table, index, ok, test.wantTable, test.wantIndex, test.wantOK)
+		}
+	}
+}
+
+func TestDiscoverBackupFiles(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := "CREATE TABLE `order_items` (`id` int);\nCREATE TABLE `events2023` (`id` int);\n" + dumpTrailer + "\n"
+
+	type archive struct {
+		name      string
+		codec     string
+		encrypted bool
+		content   string
+	}
+
+	tests := []struct {
+		name     string
+		database string
+		archives []archive
+		want     []BackupFile
+	}{
+		{
+			name:     "whole database",
+			database: "shop",
+			archives: []archive{
+				{name: "shop_ALL_20170805.sql.gz", codec: "gzip"},
+				{name: "shopping_ALL_20170805.sql.gz", codec: "gzip"},
+			},
+			want: []BackupFile{{Path: "shop_ALL_20170805.sql.gz", Kind: KindAll}},
+		},
+		{
+			name:     "schema and data",
+			database: "my_shop",
+			archives: []archive{
+				{name: "my_shop_DATA_20170805.sql.xz", codec: "xz"},
+				{name: "my_shop_SCHEMA_20170805.sql.xz", codec: "xz", content: schema},
+			},
+			want: []BackupFile{
+				{Path: "my_shop_SCHEMA_20170805.sql.xz", Kind: KindSchema},
+				{Path: "my_shop_DATA_20170805.sql.xz", Kind: KindData},
+			},
+		},
+		{
+			name:     "chunked tables",
+			database: "shop",
+			archives: []archive{
+				{name: "shop_order_items10_20170805.sql.zst", codec: "zstd"},
+				{name: "shop_order_items2_20170805.sql.zst", codec: "zstd"},
+				{name: "shop_events20231_20170805.sql.lz4", codec: "lz4"},
+				{name: "shop_order_items1_20170805.sql", codec: "none"},
+				{name: "shop_SCHEMA_20170805.sql.zst", codec: "zstd", content: schema},
+			},
+			want: []BackupFile{
+				{Path: "shop_SCHEMA_20170805.sql.zst", Kind: KindSchema},
+				{Path: "shop_events20231_20170805.sql.lz4", Kind: KindTable, Table: "events2023", Index: 1},
+				{Path: "shop_order_items1_20170805.sql", Kind: KindTable, Table: "order_items", Index: 1},
+				{Path: "shop_order_items2_20170805.sql.zst", Kind: KindTable, Table: "order_items", Index: 2},
+				{Path: "shop_order_items10_20170805.sql.zst", Kind: KindTable, Table: "order_items", Index: 10},
+			},
+		},
+		{
+			name:     "encrypted chunked tables",
+			database: "shop",
+			archives: []archive{
+				{name: "shop_events20232_20170805.sql.gz.age", codec: "gzip", encrypted: true},
+				{name: "shop_events20231_20170805.sql.gz.age", codec: "gzip", encrypted: true},
+				{name: "shop_SCHEMA_20170805.sql.gz.age", codec: "gzip", encrypted: true, content: schema},
+				{name: "shop_events20231_20170805.sql.gz.age.tmp", codec: "gzip"},
+			},
+			want: []BackupFile{
+				{Path: "shop_SCHEMA_20170805.sql.gz.age", Kind: KindSchema},
+				{Path: "shop_events20231_20170805.sql.gz.age", Kind: KindTable, Table: "events2023", Index: 1},
+				{Path: "shop_events20232_20170805.sql.gz.age", Kind: KindTable, Table: "events2023", Index: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			for _, archive := range test.archives {
+				var recipients []age.Recipient
+				if archive.encrypted {
+					recipients = []age.Recipient{identity.Recipient()}
+				}
+				content := archive.content
+				if content == "" {
+					content = testDump
+				}
+				writeTestArchive(t, dir, archive.name, archive.codec, recipients, content)
+			}
+
+			files, err := DiscoverBackupFiles(dir, test.database, []age.Identity{identity})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range test.want {
+				test.want[i].Path = filepath.Join(dir, test.want[i].Path)
+			}
+			if !reflect.DeepEqual(files, test.want) {
+				t.Errorf("DiscoverBackupFiles =\n%v\nwant\n%v", files, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverBackupFilesManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	// the manifest names the tables, the file names are not parsed
+	manifest := &Manifest{Database: "shop"}
+	manifest.AddFile(ManifestFile{File: "shop_events20232_20170805.sql.gz", Kind: KindTable, Table: "events2023", Chunk: 2})
+	manifest.AddFile(ManifestFile{File: "shop_SCHEMA_20170805.sql.gz", Kind: KindSchema})
+	manifest.AddFile(ManifestFile{File: "shop_events20231_20170805.sql.gz", Kind: KindTable, Table: "events2023", Chunk: 1})
+	if err := manifest.Write(dir, ManifestStatusSuccess); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := DiscoverBackupFiles(dir, "shop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BackupFile{
+		{Path: filepath.Join(dir, "shop_SCHEMA_20170805.sql.gz"), Kind: KindSchema},
+		{Path: filepath.Join(dir, "shop_events20231_20170805.sql.gz"), Kind: KindTable, Table: "events2023", Index: 1},
+		{Path: filepath.Join(dir, "shop_events20232_20170805.sql.gz"), Kind: KindTable, Table: "events2023", Index: 2},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("DiscoverBackupFiles =\n%v\nwant\n%v", files, want)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionTier model for one level of the grandfather-father-son rotation.
+// Each backup directory of the tier is named after its date with Layout and
+// the tier keeps the newest directory of each of its newest periods.
+type RetentionTier struct {
+	Name   string
+	Layout string
+	Period func(t time.Time) string
+}
+
+// RetentionTiers are the tiers from the shortest to the longest period. Backups are written
+// to daily and copied to the other tiers once per period.
+var RetentionTiers = []RetentionTier{
+	{Name: "hourly", Layout: "2006-01-02-15", Period: func(t time.Time) string { return t.Format("2006-01-02-15") }},
+	{Name: "daily", Layout: "2006-01-02", Period: func(t time.Time) string { return t.Format("2006-01-02") }},
+	{Name: "weekly", Layout: "2006-01-02", Period: func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}},
+	{Name: "monthly", Layout: "2006-01-02", Period: func(t time.Time) string { return t.Format("2006-01") }},
+	{Name: "yearly", Layout: "2006-01-02", Period: func(t time.Time) string { return t.Format("2006") }},
+}
+
+// RetentionPolicy is the number of periods kept by each tier, a tier missing or at 0 is disabled:
+// nothing is copied to it and nothing is removed from it
+type RetentionPolicy map[string]int
+
+// BackupDir model for one backup directory of a tier, e.g. weekly/2017-08-05
+type BackupDir struct {
+	Tier string
+	Path string
+	Date time.Time
+}
+
+// RetentionDecision tells if a backup directory is kept and the rule that decided it
+type RetentionDecision struct {
+	BackupDir
+	Keep   bool
+	Reason string
+}
+
+// NewRetentionPolicy returns the policy of the -*-rotation options
+func NewRetentionPolicy(options Options) RetentionPolicy {
+	return RetentionPolicy{
+		"hourly":  options.HourlyRotation,
+		"daily":   options.DailyRotation,
+		"weekly":  options.WeeklyRotation,
+		"monthly": options.MonthlyRotation,
+		"yearly":  options.YearlyRotation,
+	}
+}
+
+// retentionTier returns the tier named name
+func retentionTier(name string) (RetentionTier, bool) {
+	for _, tier := range RetentionTiers {
+		if tier.Name == name {
+			return tier, true
+		}
+	}
+
+	return RetentionTier{}, false
+}
+
+// ParseBackupDir returns the backup directory at p, e.g. daily/2017-08-05.
+// ok is false when p is not directly below a tier or its name is not a date in the layout of the tier.
+func ParseBackupDir(p string) (dir BackupDir, ok bool) {
+	tier, found := retentionTier(path.Dir(p))
+	if !found {
+		return BackupDir{}, false
+	}
+
+	date, err := time.ParseInLocation(tier.Layout, path.Base(p), time.Local)
+	if err != nil {
+		return BackupDir{}, false
+	}
+
+	return BackupDir{Tier: tier.Name, Path: p, Date: date}, true
+}
+
+// PlanRetention decides which dirs are kept by policy. In each enabled tier, the newest directory
+// of each of the newest periods is kept, up to the number of periods of the tier; the older
+// directories and the other directories of a kept period expire. Directories of disabled tiers are kept.
+// protected maps each database to its newest successful database directory, whose backup directory never expires:
+// a database failing more days in a row than a tier keeps still has its last good backup.
+func PlanRetention(dirs []BackupDir, policy RetentionPolicy, protected map[string]string) []RetentionDecision {
+	sorted := append([]BackupDir(nil), dirs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Date.After(sorted[j].Date) })
+
+	holding := map[string][]string{}
+	for database, dir := range protected {
+		holding[path.Dir(dir)] = append(holding[path.Dir(dir)], database)
+	}
+
+	var decisions []RetentionDecision
+	for _, tier := range RetentionTiers {
+		keep := policy[tier.Name]
+		periods := map[string]bool{}
+
+		for _, dir := range sorted {
+			if dir.Tier != tier.Name {
+				continue
+			}
+
+			period := tier.Period(dir.Date)
+			decision := RetentionDecision{BackupDir: dir}
+
+			switch {
+			case keep <= 0:
+				decision.Keep = true
+				decision.Reason = tier.Name + " rotation disabled"
+			case periods[period]:
+				decision.Reason = fmt.Sprintf("a newer %s backup of %s is kept", tier.Name, period)
+			case len(periods) < keep:
+				periods[period] = true
+				decision.Keep = true
+				decision.Reason = fmt.Sprintf("%s %d of %d (%s)", tier.Name, len(periods), keep, period)
+			default:
+				decision.Reason = fmt.Sprintf("older than the %d newest %s periods", keep, tier.Name)
+			}
+
+			if databases := holding[dir.Path]; !decision.Keep && len(databases) > 0 {
+				sort.Strings(databases)
+				decision.Keep = true
+				decision.Reason = "newest successful backup of " + strings.Join(databases, ", ")
+			}
+
+			decisions = append(decisions, decision)
+		}
+	}
+
+	return decisions
+}
+
+// newestSuccessfulBackups returns the newest database directory of dirs whose backup succeeded, by database,
+// a daily one over its copies in the other tiers. success tells the directories whose manifest reports a successful backup.
+func newestSuccessfulBackups(dirs []DatabaseDir, success map[string]bool) map[string]string {
+	tierOrder := map[string]int{}
+	for i, tier := range RetentionTiers {
+		tierOrder[tier.Name] = i
+	}
+
+	newest := map[string]DatabaseDir{}
+	for _, dir := range dirs {
+		current, found := newest[dir.Database]
+		if success[dir.Path] && (!found || dir.Date.After(current.Date) || (dir.Date.Equal(current.Date) && tierOrder[dir.Tier] < tierOrder[current.Tier])) {
+			newest[dir.Database] = dir
+		}
+	}
+
+	protected := map[string]string{}
+	for database, dir := range newest {
+		protected[database] = dir.Path
+	}
+
+	return protected
+}
+
+// DatabaseDir model for the backup of one database in a backup directory, e.g. weekly/2017-08-05/shop-2017-08-05
+type DatabaseDir struct {
+	BackupDir
+	Database string
+}
+
+// ParseDatabaseDir returns the database directory at p, e.g. daily/2017-08-05/shop-2017-08-05.
+// ok is false when p is not in a backup directory or its name is not {DATABASE_NAME}-{DATE}.
+func ParseDatabaseDir(p string) (dir DatabaseDir, ok bool) {
+	backup, ok := ParseBackupDir(path.Dir(p))
+	if !ok {
+		return DatabaseDir{}, false
+	}
+
+	database := sourceDatabaseFromDir(p)
+	if database == "" {
+		return DatabaseDir{}, false
+	}
+
+	backup.Path = p
+
+	return DatabaseDir{BackupDir: backup, Database: database}, true
+}
+
+// Promotion model for the copy of a database directory of the daily backup to another tier
+type Promotion struct {
+	Source      string
+	Destination string
+}
+
+// PlanPromotions returns the copies of the database directories daily, of the daily backup of date, to the
+// other enabled tiers: each database is copied to each tier that has no backup of it in the period of date yet.
+// dirs are the database directories of every tier. A database is copied to the backup directory already holding
+// the other databases of the period, if any, so that the rotation keeps every database of a period.
+func PlanPromotions(date time.Time, daily []DatabaseDir, dirs []DatabaseDir, policy RetentionPolicy) []Promotion {
+	var promotions []Promotion
+
+	for _, tier := range RetentionTiers {
+		if tier.Name == "daily" || policy[tier.Name] <= 0 {
+			continue
+		}
+
+		target := BackupDir{Path: tier.Name + "/" + date.Format(tier.Layout)}
+		covered := map[string]bool{}
+		for _, dir := range dirs {
+			if dir.Tier != tier.Name || tier.Period(dir.Date) != tier.Period(date) {
+				continue
+			}
+
+			covered[dir.Database] = true
+			if target.Date.IsZero() || dir.Date.After(target.Date) {
+				target = BackupDir{Path: path.Dir(dir.Path), Date: dir.Date}
+			}
+		}
+
+		for _, dir := range daily {
+			if !covered[dir.Database] {
+				promotions = append(promotions, Promotion{
+					Source:      dir.Path,
+					Destination: target.Path + "/" + path.Base(dir.Path),
+				})
+			}
+		}
+	}
+
+	return promotions
+}
+
+// listDatabaseDirs returns the database directories of every tier in storage
+func listDatabaseDirs(storage Storage) ([]DatabaseDir, error) {
+	var dirs []DatabaseDir
+
+	for _, tier := range RetentionTiers {
+		objects, err := storage.List(tier.Name + "/")
+		if err != nil {
+			return nil, fmt.Errorf("list %s backups in %s: %v", tier.Name, storage.String(), err)
+		}
+
+		seen := map[string]bool{}
+		for _, object := range objects {
+			parts := strings.SplitN(object.Key, "/", 4)
+			if len(parts) < 4 {
+				continue
+			}
+
+			p := path.Join(parts[0], parts[1], parts[2])
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+
+			if dir, ok := ParseDatabaseDir(p); ok {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	return dirs, nil
+}
+
+// protectedBackups returns the newest successful database directory of each database of dirs, in storage
+func protectedBackups(storage Storage, dirs []DatabaseDir) (map[string]string, error) {
+	success := map[string]bool{}
+	for _, dir := range dirs {
+		succeeded, err := readManifestSuccess(storage, dir.Path)
+		if err != nil {
+			return nil, err
+		}
+		success[dir.Path] = succeeded
+	}
+
+	return newestSuccessfulBackups(dirs, success), nil
+}
+
+// listBackupDirs returns the backup directories of every tier in storage.
+// Directories whose name is not a date are left out, with a warning.
+func listBackupDirs(options Options, storage Storage) ([]BackupDir, error) {
+	var dirs []BackupDir
+
+	for _, tier := range RetentionTiers {
+		found, err := StorageDirs(storage, tier.Name)
+		if err != nil {
+			return nil, fmt.Errorf("list %s backups in %s: %v", tier.Name, storage.String(), err)
+		}
+
+		for p := range found {
+			dir, ok := ParseBackupDir(p)
+			if !ok {
+				printMessage("Ignoring "+p+" in the rotation, its name is not a "+tier.Layout+" date", options.Verbosity, Warning)
+				continue
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs, nil
+}
+
+// BackupRotation copies each database of the daily backup of this run to the tiers whose current period has
+// no backup of it yet, then removes the backup directories of every tier that the retention policy no longer keeps.
+// Only the databases whose manifest reports a successful backup are copied.
+func BackupRotation(options Options, storage Storage) {
+	policy := NewRetentionPolicy(options)
+
+	dirs, err := listBackupDirs(options, storage)
+	if err != nil {
+		printMessage("error to rotate backups: "+err.Error(), options.Verbosity, Error)
+		return
+	}
+
+	databases, err := listDatabaseDirs(storage)
+	if err != nil {
+		printMessage("error to rotate backups: "+err.Error(), options.Verbosity, Error)
+		return
+	}
+
+	today := "daily/" + options.ExecutionStartDate.Format("2006-01-02")
+	var daily []DatabaseDir
+	for _, dir := range databases {
+		if path.Dir(dir.Path) != today {
+			continue
+		}
+		success, err := readManifestSuccess(storage, dir.Path)
+		if err != nil {
+			printEvent("Not promoting "+dir.Path+": "+err.Error(), options.Verbosity, Error, LogFields{"database": dir.Database, "file": dir.Path})
+			continue
+		}
+		if !success {
+			printEvent("Not promoting "+dir.Path+", its backup did not succeed", options.Verbosity, Warning, LogFields{"database": dir.Database, "file": dir.Path})
+			continue
+		}
+		daily = append(daily, dir)
+	}
+
+	listed := map[string]bool{}
+	for _, dir := range dirs {
+		listed[dir.Path] = true
+	}
+
+	for _, promotion := range PlanPromotions(options.ExecutionStartDate, daily, databases, policy) {
+		start := time.Now()
+		methods, err := CopyStorageDir(storage, promotion.Source, promotion.Destination)
+		if err != nil {
+			printMessage("error to copy "+promotion.Source+" to "+promotion.Destination+": "+err.Error(), options.Verbosity, Error)
+			continue
+		}
+
+		printEvent(fmt.Sprintf("Promoted %s to %s : %d hardlinks, %d reflinks, %d server-side copies, %d copies", promotion.Source, promotion.Destination, methods["hardlink"], methods["reflink"], methods["server-side copy"], methods["copy"]), options.Verbosity, Info, LogFields{"file": promotion.Destination, "duration": time.Since(start)})
+
+		if dir, ok := ParseBackupDir(path.Dir(promotion.Destination)); ok && !listed[dir.Path] {
+			listed[dir.Path] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	protected, err := protectedBackups(storage, databases)
+	if err != nil {
+		printMessage("error to rotate backups: "+err.Error(), options.Verbosity, Error)
+		return
+	}
+
+	applyRetention(options, storage, PlanRetention(dirs, policy, protected), false)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(t *testing.T, layout string, value string) time.Time {
+	t.Helper()
+	d, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// backupTree writes one archive in each database directory of keys, e.g. daily/2017-08-05/shop-2017-08-05,
+// to a LocalStorage in a temporary directory
+func backupTree(t *testing.T, dirs ...string) *LocalStorage {
+	t.Helper()
+	storage := &LocalStorage{Root: t.TempDir()}
+
+	for _, dir := range dirs {
+		putString(t, storage, dir+"/"+strings.SplitN(dir[strings.LastIndex(dir, "/")+1:], "-", 2)[0]+"_ALL.sql.gz", dir)
+	}
+
+	return storage
+}
+
+func TestParseBackupDir(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+		date string
+	}{
+		{"daily/2017-08-05", true, "2017-08-05 00:00"},
+		{"weekly/2017-07-31", true, "2017-07-31 00:00"},
+		{"hourly/2017-08-05-14", true, "2017-08-05 14:00"},
+		{"hourly/2017-08-05", false, ""},
+		{"daily/2017-08-05-14", false, ""},
+		{"daily/latest", false, ""},
+		{"daily/2017-13-01", false, ""},
+		{"archive/2017-08-05", false, ""},
+		{"daily/2017-08-05/shop-2017-08-05", false, ""},
+	}
+
+	for _, test := range tests {
+		dir, ok := ParseBackupDir(test.path)
+		if ok != test.ok {
+			t.Errorf("ParseBackupDir(%s) ok = %v, want %v", test.path, ok, test.ok)
+			continue
+		}
+		if ok && dir.Date.Format("2006-01-02 15:04") != test.date {
+			t.Errorf("ParseBackupDir(%s) date = %s, want %s", test.path, dir.Date.Format("2006-01-02 15:04"), test.date)
+		}
+	}
+}
+
+func TestParseDatabaseDir(t *testing.T) {
+	tests := []struct {
+		path     string
+		ok       bool
+		tier     string
+		database string
+	}{
+		{"daily/2017-08-05/shop-2017-08-05", true, "daily", "shop"},
+		{"hourly/2017-08-05-14/shop-2017-08-05", true, "hourly", "shop"},
+		{"weekly/2017-07-31/my-shop-2017-07-31", true, "weekly", "my-shop"},
+		{"daily/2017-08-05/shop", false, "", ""},
+		{"daily/latest/shop-2017-08-05", false, "", ""},
+	}
+
+	for _, test := range tests {
+		dir, ok := ParseDatabaseDir(test.path)
+		if ok != test.ok {
+			t.Errorf("ParseDatabaseDir(%s) ok = %v, want %v", test.path, ok, test.ok)
+			continue
+		}
+		if ok && (dir.Tier != test.tier || dir.Database != test.database || dir.Path != test.path) {
+			t.Errorf("ParseDatabaseDir(%s) = %s %s %s, want %s %s", test.path, dir.Tier, dir.Database, dir.Path, test.tier, test.database)
+		}
+	}
+}
+
+func TestPlanRetention(t *testing.T) {
+	tests := []struct {
+		name   string
+		dirs   []string
+		failed []string
+		policy RetentionPolicy
+		keep   []string
+		expire map[string]string
+	}{
+		{
+			name: "daily keeps the newest days",
+			dirs: []string{
+				"daily/2017-08-01/shop-2017-08-01",
+				"daily/2017-08-02/shop-2017-08-02",
+				"daily/2017-08-03/shop-2017-08-03",
+				"daily/2017-08-04/shop-2017-08-04",
+				"daily/2017-08-05/shop-2017-08-05",
+			},
+			policy: RetentionPolicy{"daily": 3},
+			keep:   []string{"daily/2017-08-03", "daily/2017-08-04", "daily/2017-08-05"},
+			expire: map[string]string{
+				"daily/2017-08-01": "older than the 3 newest daily periods",
+				"daily/2017-08-02": "older than the 3 newest daily periods",
+			},
+		},
+		{
+			name: "hourly keeps the newest hours",
+			dirs: []string{
+				"hourly/2017-08-04-23/shop-2017-08-04",
+				"hourly/2017-08-05-00/shop-2017-08-05",
+				"hourly/2017-08-05-01/shop-2017-08-05",
+			},
+			policy: RetentionPolicy{"hourly": 2},
+			keep:   []string{"hourly/2017-08-05-00", "hourly/2017-08-05-01"},
+			expire: map[string]string{"hourly/2017-08-04-23": "older than the 2 newest hourly periods"},
+		},
+		{
+			name: "weekly periods are ISO weeks across the new year",
+			dirs: []string{
+				// 2016-W52 runs from Monday 2016-12-26 to Sunday 2017-01-01
+				"weekly/2016-12-26/shop-2016-12-26",
+				"weekly/2017-01-01/shop-2017-01-01",
+				"weekly/2017-01-02/shop-2017-01-02",
+			},
+			policy: RetentionPolicy{"weekly": 2},
+			keep:   []string{"weekly/2017-01-01", "weekly/2017-01-02"},
+			expire: map[string]string{"weekly/2016-12-26": "a newer weekly backup of 2016-W52 is kept"},
+		},
+		{
+			name: "weekly periods of a year with 53 ISO weeks",
+			dirs: []string{
+				"weekly/2015-12-28/shop-2015-12-28",
+				"weekly/2016-01-03/shop-2016-01-03",
+				"weekly/2016-01-04/shop-2016-01-04",
+			},
+			policy: RetentionPolicy{"weekly": 3},
+			keep:   []string{"weekly/2016-01-03", "weekly/2016-01-04"},
+			expire: map[string]string{"weekly/2015-12-28": "a newer weekly backup of 2015-W53 is kept"},
+		},
+		{
+			name: "monthly periods are calendar months",
+			dirs: []string{
+				"monthly/2017-01-01/shop-2017-01-01",
+				"monthly/2017-01-31/shop-2017-01-31",
+				"monthly/2017-02-01/shop-2017-02-01",
+				"monthly/2017-02-28/shop-2017-02-28",
+			},
+			policy: RetentionPolicy{"monthly": 2},
+			keep:   []string{"monthly/2017-01-31", "monthly/2017-02-28"},
+			expire: map[string]string{
+				"monthly/2017-01-01": "a newer monthly backup of 2017-01 is kept",
+				"monthly/2017-02-01": "a newer monthly backup of 2017-02 is kept",
+			},
+		},
+		{
+			name: "yearly periods are calendar years",
+			dirs: []string{
+				"yearly/2015-06-01/shop-2015-06-01",
+				"yearly/2016-01-01/shop-2016-01-01",
+				"yearly/2016-12-31/shop-2016-12-31",
+				"yearly/2017-01-01/shop-2017-01-01",
+			},
+			policy: RetentionPolicy{"yearly": 2},
+			keep:   []string{"yearly/2016-12-31", "yearly/2017-01-01"},
+			expire: map[string]string{
+				"yearly/2015-06-01": "older than the 2 newest yearly periods",
+				"yearly/2016-01-01": "a newer yearly backup of 2016 is kept",
+			},
+		},
+		{
+			name: "disabled tiers are kept",
+			dirs: []string{
+				"daily/2017-08-04/shop-2017-08-04",
+				"daily/2017-08-05/shop-2017-08-05",
+				"weekly/2017-07-24/shop-2017-07-24",
+				"weekly/2017-07-31/shop-2017-07-31",
+				"monthly/2017-06-01/shop-2017-06-01",
+			},
+			policy: RetentionPolicy{"daily": 1, "weekly": 0},
+			keep:   []string{"daily/2017-08-05", "weekly/2017-07-24", "weekly/2017-07-31", "monthly/2017-06-01"},
+			expire: map[string]string{"daily/2017-08-04": "older than the 1 newest daily periods"},
+		},
+		{
+			name: "names that are not dates are ignored",
+			dirs: []string{
+				"daily/2017-08-04/shop-2017-08-04",
+				"daily/2017-08-05/shop-2017-08-05",
+				"daily/latest/shop-2017-08-05",
+				"weekly/2017-08-05-14/shop-2017-08-05",
+			},
+			policy: RetentionPolicy{"daily": 1, "weekly": 1},
+			keep:   []string{"daily/2017-08-05"},
+			expire: map[string]string{"daily/2017-08-04": "older than the 1 newest daily periods"},
+		},
+		{
+			name: "failed days do not expire the last successful backup",
+			dirs: []string{
+				"daily/2017-08-01/shop-2017-08-01",
+				"daily/2017-08-02/shop-2017-08-02",
+				"daily/2017-08-03/shop-2017-08-03",
+				"daily/2017-08-04/shop-2017-08-04",
+			},
+			failed: []string{"daily/2017-08-03/shop-2017-08-03", "daily/2017-08-04/shop-2017-08-04"},
+			policy: RetentionPolicy{"daily": 2},
+			keep:   []string{"daily/2017-08-02", "daily/2017-08-03", "daily/2017-08-04"},
+			expire: map[string]string{"daily/2017-08-01": "older than the 2 newest daily periods"},
+		},
+		{
+			name: "the last successful backup of each database is kept",
+			dirs: []string{
+				"daily/2017-08-01/blog-2017-08-01",
+				"daily/2017-08-01/shop-2017-08-01",
+				"daily/2017-08-02/blog-2017-08-02",
+				"daily/2017-08-02/shop-2017-08-02",
+				"daily/2017-08-03/blog-2017-08-03",
+				"daily/2017-08-03/shop-2017-08-03",
+			},
+			failed: []string{"daily/2017-08-02/shop-2017-08-02", "daily/2017-08-03/shop-2017-08-03"},
+			policy: RetentionPolicy{"daily": 1},
+			keep:   []string{"daily/2017-08-01", "daily/2017-08-03"},
+			expire: map[string]string{"daily/2017-08-02": "older than the 1 newest daily periods"},
+		},
+		{
+			name: "a database that never succeeded keeps nothing",
+			dirs: []string{
+				"daily/2017-08-01/shop-2017-08-01",
+				"daily/2017-08-02/shop-2017-08-02",
+			},
+			failed: []string{"daily/2017-08-01/shop-2017-08-01", "daily/2017-08-02/shop-2017-08-02"},
+			policy: RetentionPolicy{"daily": 1},
+			keep:   []string{"daily/2017-08-02"},
+			expire: map[string]string{"daily/2017-08-01": "older than the 1 newest daily periods"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := backupTree(t, test.dirs...)
+			for _, dir := range test.failed {
+				putString(t, storage, dir+"/"+ManifestFilename, `{"Status": "failed"}`)
+			}
+
+			dirs, err := listBackupDirs(Options{Verbosity: -1}, storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			databases, err := listDatabaseDirs(storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			protected, err := protectedBackups(storage, databases)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var keep []string
+			expire := map[string]string{}
+			for _, decision := range PlanRetention(dirs, test.policy, protected) {
+				if decision.Keep {
+					keep = append(keep, decision.Path)
+				} else {
+					expire[decision.Path] = decision.Reason
+				}
+			}
+
+			sort.Strings(keep)
+			want := append([]string(nil), test.keep...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(keep, want) {
+				t.Errorf("kept %v, want %v", keep, want)
+			}
+			if !reflect.DeepEqual(expire, test.expire) {
+				t.Errorf("expired %v, want %v", expire, test.expire)
+			}
+		})
+	}
+}
+
+func TestPlanPromotions(t *testing.T) {
+	daily := []string{"daily/2017-08-05/crm-2017-08-05", "daily/2017-08-05/shop-2017-08-05"}
+
+	tests := []struct {
+		name   string
+		date   string
+		dirs   []string
+		policy RetentionPolicy
+		want   []Promotion
+	}{
+		{
+			name:   "every database to every enabled tier",
+			date:   "2017-08-05 14:10",
+			policy: RetentionPolicy{"hourly": 24, "daily": 7, "weekly": 2, "monthly": 0},
+			want: []Promotion{
+				{"daily/2017-08-05/crm-2017-08-05", "hourly/2017-08-05-14/crm-2017-08-05"},
+				{"daily/2017-08-05/shop-2017-08-05", "hourly/2017-08-05-14/shop-2017-08-05"},
+				{"daily/2017-08-05/crm-2017-08-05", "weekly/2017-08-05/crm-2017-08-05"},
+				{"daily/2017-08-05/shop-2017-08-05", "weekly/2017-08-05/shop-2017-08-05"},
+			},
+		},
+		{
+			name: "a database already backed up in the period is not promoted",
+			date: "2017-08-05 14:10",
+			dirs: []string{
+				// same ISO week 2017-W31 and same month
+				"weekly/2017-07-31/shop-2017-07-31",
+				"monthly/2017-08-01/crm-2017-08-01",
+				"monthly/2017-08-01/shop-2017-08-01",
+			},
+			policy: RetentionPolicy{"weekly": 2, "monthly": 6},
+			want: []Promotion{
+				{"daily/2017-08-05/crm-2017-08-05", "weekly/2017-07-31/crm-2017-08-05"},
+			},
+		},
+		{
+			name: "a backup of the previous period does not cover the current one",
+			date: "2017-08-07 01:00",
+			dirs: []string{
+				// Sunday of 2017-W31, the run is on Monday of 2017-W32
+				"weekly/2017-08-06/crm-2017-08-06",
+				"weekly/2017-08-06/shop-2017-08-06",
+				"yearly/2016-12-31/crm-2016-12-31",
+				"yearly/2017-01-01/shop-2017-01-01",
+			},
+			policy: RetentionPolicy{"weekly": 2, "yearly": 3},
+			want: []Promotion{
+				{"daily/2017-08-05/crm-2017-08-05", "weekly/2017-08-07/crm-2017-08-05"},
+				{"daily/2017-08-05/shop-2017-08-05", "weekly/2017-08-07/shop-2017-08-05"},
+				{"daily/2017-08-05/crm-2017-08-05", "yearly/2017-01-01/crm-2017-08-05"},
+			},
+		},
+		{
+			name: "the next hour of the same day is promoted again",
+			date: "2017-08-05 15:00",
+			dirs: []string{
+				"hourly/2017-08-05-14/crm-2017-08-05",
+				"hourly/2017-08-05-14/shop-2017-08-05",
+			},
+			policy: RetentionPolicy{"hourly": 24},
+			want: []Promotion{
+				{"daily/2017-08-05/crm-2017-08-05", "hourly/2017-08-05-15/crm-2017-08-05"},
+				{"daily/2017-08-05/shop-2017-08-05", "hourly/2017-08-05-15/shop-2017-08-05"},
+			},
+		},
+		{
+			name:   "nothing with every other tier disabled",
+			date:   "2017-08-05 14:10",
+			policy: RetentionPolicy{"daily": 7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := backupTree(t, append(append([]string(nil), daily...), test.dirs...)...)
+
+			databases, err := listDatabaseDirs(storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var today []DatabaseDir
+			for _, dir := range databases {
+				if dir.Tier == "daily" {
+					today = append(today, dir)
+				}
+			}
+
+			got := PlanPromotions(date(t, "2006-01-02 15:04", test.date), today, databases, test.policy)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("PlanPromotions = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackupRotationPromotesSuccessfulDatabases(t *testing.T) {
+	storage := backupTree(t,
+		"daily/2017-08-04/shop-2017-08-04",
+		"daily/2017-08-05/billing-2017-08-05",
+		"daily/2017-08-05/crm-2017-08-05",
+		"daily/2017-08-05/shop-2017-08-05",
+		"weekly/2017-07-31/crm-2017-07-31",
+	)
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/"+ManifestFilename, `{"Status": "success"}`)
+	putString(t, storage, "daily/2017-08-05/billing-2017-08-05/"+ManifestFilename, `{"Status": "failed"}`)
+
+	options := Options{
+		Verbosity:          -1,
+		ExecutionStartDate: date(t, "2006-01-02 15:04", "2017-08-05 14:10"),
+		DailyRotation:      1,
+		WeeklyRotation:     2,
+		MonthlyRotation:    1,
+	}
+
+	BackupRotation(options, storage)
+
+	want := []string{
+		// crm has no manifest, as written by older versions, it is taken as successful
+		"daily/2017-08-05/billing-2017-08-05/billing_ALL.sql.gz",
+		"daily/2017-08-05/billing-2017-08-05/manifest.json",
+		"daily/2017-08-05/crm-2017-08-05/crm_ALL.sql.gz",
+		"daily/2017-08-05/shop-2017-08-05/manifest.json",
+		"daily/2017-08-05/shop-2017-08-05/shop_ALL.sql.gz",
+		"monthly/2017-08-05/crm-2017-08-05/crm_ALL.sql.gz",
+		"monthly/2017-08-05/shop-2017-08-05/manifest.json",
+		"monthly/2017-08-05/shop-2017-08-05/shop_ALL.sql.gz",
+		"weekly/2017-07-31/crm-2017-07-31/crm_ALL.sql.gz",
+		"weekly/2017-07-31/shop-2017-08-05/manifest.json",
+		"weekly/2017-07-31/shop-2017-08-05/shop_ALL.sql.gz",
+	}
+
+	var got []string
+	for _, tier := range []string{"daily/", "monthly/", "weekly/"} {
+		got = append(got, listKeys(t, storage, tier)...)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backups after the rotation:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// maxRetryBackoff caps the exponential backoff between two attempts
+const maxRetryBackoff = 5 * time.Minute
+
+// retryableMySQLErrors are the server and client error codes of transient failures
+var retryableMySQLErrors = map[uint16]bool{
+	1040: true, // Too many connections
+	1053: true, // Server shutdown in progress
+	1205: true, // Lock wait timeout exceeded
+	1213: true, // Deadlock found when trying to get lock
+	2002: true, // Can't connect to local MySQL server through socket
+	2003: true, // Can't connect to MySQL server
+	2006: true, // MySQL server has gone away
+	2013: true, // Lost connection to MySQL server during query
+}
+
+// retryableMessages are the messages of transient failures written by mysqldump on stderr
+var retryableMessages = []string{
+	"lost connection to mysql server",
+	"mysql server has gone away",
+	"can't connect to mysql server",
+	"can't connect to local mysql server",
+	"too many connections",
+	"lock wait timeout exceeded",
+	"deadlock found",
+	"server shutdown in progress",
+	"connection reset by peer",
+	"broken pipe",
+	"i/o timeout",
+	"invalid connection",
+}
+
+// IsRetryable tells if err is a transient failure worth another attempt:
+// a lost or refused connection, a deadlock or a lock wait timeout
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return retryableMySQLErrors[mysqlErr.Number]
+	}
+
+	var netErr net.Error
+	if errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, retryable := range retryableMessages {
+		if strings.Contains(message, retryable) {
+			return true
+		}
+	}
+
+	for code := range retryableMySQLErrors {
+		if strings.Contains(message, fmt.Sprintf("error: %d", code)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryBackoff returns the wait before attempt, doubling options.RetryBackoff after each failed attempt
+func retryBackoff(options Options, attempt int) time.Duration {
+	backoff := options.RetryBackoff
+	for i := 2; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+
+	return backoff
+}
+
+// withRetry calls run up to options.RetryAttempts times while it fails with a retryable error.
+// cleanup is called after each failed attempt to remove its partial output.
+func withRetry(options Options, description string, fields LogFields, cleanup func(), run func() error) error {
+	attempts := options.RetryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			backoff := retryBackoff(options, attempt)
+
+			retryFields := LogFields{"attempt": attempt, "error": err, "backoff": backoff}
+			for name, value := range fields {
+				retryFields[name] = value
+			}
+			printEvent(fmt.Sprintf("Retrying %s in %s, attempt %d of %d : %v", description, backoff, attempt, attempts, err), options.Verbosity, Warning, retryFields)
+			recordDumpRetry(options, fmt.Sprint(fields["database"]))
+
+			time.Sleep(backoff)
+		}
+
+		if err = run(); err == nil {
+			return nil
+		}
+
+		if cleanup != nil {
+			cleanup()
+		}
+
+		if !IsRetryable(err) {
+			return err
+		}
+	}
+
+	if attempts > 1 {
+		return fmt.Errorf("%v (gave up after %d attempts)", err, attempts)
+	}
+
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"lost connection", &mysql.MySQLError{Number: 2013, Message: "Lost connection to MySQL server during query"}, true},
+		{"gone away", &mysql.MySQLError{Number: 2006, Message: "MySQL server has gone away"}, true},
+		{"too many connections", &mysql.MySQLError{Number: 1040, Message: "Too many connections"}, true},
+		{"deadlock", &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, true},
+		{"lock wait timeout", &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, true},
+		{"wrapped deadlock", fmt.Errorf("dump: %w", &mysql.MySQLError{Number: 1213}), true},
+		{"access denied", &mysql.MySQLError{Number: 1045, Message: "Access denied for user 'root'@'localhost'"}, false},
+		{"unknown database", &mysql.MySQLError{Number: 1049, Message: "Unknown database 'shop'"}, false},
+		{"syntax error", &mysql.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax"}, false},
+		{"invalid connection", mysql.ErrInvalidConn, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"refused connection", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"mysqldump lost connection", errors.New("mysqldump: Error 2013: Lost connection to MySQL server during query when dumping table `orders` at row: 1024"), true},
+		{"mysqldump gone away", errors.New("mysqldump: Got error: 2006: MySQL server has gone away when selecting the database"), true},
+		{"mysqldump error code", errors.New("mysqldump: Got error: 2003: connecting"), true},
+		{"mysqldump access denied", errors.New("mysqldump: Got error: 1045: Access denied for user 'root'@'localhost' (using password: YES) when trying to connect"), false},
+		{"mysqldump unknown table", errors.New("mysqldump: Couldn't find table: \"orders\""), false},
+		{"disk full", errors.New("write /backups/shop_ALL.sql.gz: no space left on device"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsRetryable(test.err); got != test.want {
+				t.Errorf("IsRetryable(%v) = %t, want %t", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{10 * time.Second, 2, 10 * time.Second},
+		{10 * time.Second, 3, 20 * time.Second},
+		{10 * time.Second, 4, 40 * time.Second},
+		{10 * time.Second, 6, 160 * time.Second},
+		{10 * time.Second, 7, maxRetryBackoff},
+		{10 * time.Second, 50, maxRetryBackoff},
+		{10 * time.Minute, 2, maxRetryBackoff},
+		{0, 5, 0},
+	}
+
+	for _, test := range tests {
+		if got := retryBackoff(Options{RetryBackoff: test.backoff}, test.attempt); got != test.want {
+			t.Errorf("retryBackoff(%s, attempt %d) = %s, want %s", test.backoff, test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	transient := &mysql.MySQLError{Number: 2013, Message: "Lost connection to MySQL server during query"}
+	fatal := &mysql.MySQLError{Number: 1045, Message: "Access denied for user 'root'@'localhost'"}
+
+	tests := []struct {
+		name     string
+		attempts int
+		errs     []error
+		wantRuns int
+		wantErr  bool
+	}{
+		{"success", 3, nil, 1, false},
+		{"transient then success", 3, []error{transient, transient}, 3, false},
+		{"attempt limit", 3, []error{transient, transient, transient, transient}, 3, true},
+		{"fatal error", 3, []error{fatal}, 1, true},
+		{"transient then fatal", 3, []error{transient, fatal}, 2, true},
+		{"retries disabled", 1, []error{transient}, 1, true},
+		{"attempts below one", 0, []error{transient}, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := Options{Verbosity: -1, RetryAttempts: test.attempts, RetryBackoff: time.Millisecond}
+
+			runs, cleanups := 0, 0
+			err := withRetry(options, "dump", LogFields{"database": "shop"}, func() { cleanups++ }, func() error {
+				runs++
+				if runs <= len(test.errs) {
+					return test.errs[runs-1]
+				}
+				return nil
+			})
+
+			if runs != test.wantRuns {
+				t.Errorf("run called %d times, want %d", runs, test.wantRuns)
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("withRetry error = %v, want error %t", err, test.wantErr)
+			}
+			// every failed attempt removes its partial output
+			if failed := runs - 1; err != nil && cleanups != runs || err == nil && cleanups != failed {
+				t.Errorf("cleanup called %d times after %d runs", cleanups, runs)
+			}
+		})
+	}
+}
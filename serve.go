@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// scheduledBackup is the cron job of one profile, a run is skipped while the previous one is still running
+type scheduledBackup struct {
+	options Options
+	running int32
+	lock    *sync.Mutex
+}
+
+// Run backs up the databases of the profile, rotation included, as a single backup invocation would
+func (s *scheduledBackup) Run() {
+	name := s.options.Profile
+	if name == "" {
+		name = s.options.HostName
+	}
+
+	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
+		printMessage("Skipping scheduled backup of "+name+", the previous run is still running", s.options.Verbosity, Warning)
+		return
+	}
+	defer atomic.StoreInt32(&s.running, 0)
+
+	// profiles sharing an output directory run one after the other so their rotations do not interfere
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	options := s.options
+	options.ExecutionStartDate = time.Now()
+
+	printEvent("Scheduled backup started : "+name, options.Verbosity, Info, LogFields{"profile": name})
+
+	summary := runBackup(options)
+	if summary.Status != ManifestStatusSuccess {
+		printEvent(fmt.Sprintf("Scheduled backup of %s failed with %d errors", name, len(summary.Errors)), options.Verbosity, Error, LogFields{"profile": name, "duration": time.Since(options.ExecutionStartDate)})
+		for _, err := range summary.Errors {
+			printMessage(err, options.Verbosity, Error)
+		}
+		return
+	}
+
+	printEvent(fmt.Sprintf("Scheduled backup of %s done in %s", name, time.Since(options.ExecutionStartDate).Round(time.Second)), options.Verbosity, Info, LogFields{"profile": name, "duration": time.Since(options.ExecutionStartDate)})
+}
+
+// Serve runs the backups of every profile on its -schedule until SIGINT or SIGTERM and returns the process exit code
+func Serve(allOptions []*Options) int {
+	verbosity := allOptions[len(allOptions)-1].Verbosity
+
+	scheduler := cron.New()
+	locks := map[string]*sync.Mutex{}
+	listening := map[string]bool{}
+
+	for _, options := range allOptions {
+		name := options.Profile
+		if name == "" {
+			name = options.HostName
+		}
+
+		if options.Schedule == "" {
+			printMessage("no -schedule for "+name+", mars serve needs one for every profile", verbosity, Error)
+			return 1
+		}
+
+		schedule, err := cron.ParseStandard(options.Schedule)
+		if err != nil {
+			printMessage("invalid schedule of "+name+": "+err.Error(), verbosity, Error)
+			return 1
+		}
+
+		if options.MetricsListen != "" && !listening[options.MetricsListen] {
+			listening[options.MetricsListen] = true
+			ServeMetrics(options.MetricsListen, verbosity)
+		}
+
+		if locks[options.OutputDirectory] == nil {
+			locks[options.OutputDirectory] = &sync.Mutex{}
+		}
+
+		scheduler.Schedule(schedule, &scheduledBackup{options: *options, lock: locks[options.OutputDirectory]})
+
+		printMessage(fmt.Sprintf("Scheduled %s at %q, next run at %s", name, options.Schedule, schedule.Next(time.Now()).Format(time.RFC3339)), verbosity, Info)
+	}
+
+	scheduler.Start()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+
+	printMessage("Received "+received.String()+", waiting for the running backups to finish", verbosity, Info)
+	<-scheduler.Stop().Done()
+
+	return 0
+}
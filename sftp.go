@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpUploadAttempts is how many times Put reconnects and resumes an interrupted upload
+const sftpUploadAttempts = 3
+
+// SFTPStorage keeps the backup tree in a directory of an SSH host
+type SFTPStorage struct {
+	address string
+	config  *ssh.ClientConfig
+	root    string
+
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// NewSFTPStorage returns a new SFTPStorage instance for sftp://user@host[:port]/path.
+// It authenticates with keyFile when given, and with the keys of the running ssh-agent,
+// and checks the host key against knownHostsFile.
+func NewSFTPStorage(location string, keyFile string, knownHostsFile string) (*SFTPStorage, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("storage %q has no user", location)
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	root := path.Clean("/" + u.Path)
+
+	var auth []ssh.AuthMethod
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no ssh key for %s, please specify -sftp-key or start an ssh-agent", location)
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &SFTPStorage{
+		address: address,
+		root:    root,
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+	}
+
+	if err := storage.connect(); err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// connect opens, or opens again after a failure, the ssh connection and the sftp session
+func (s *SFTPStorage) connect() error {
+	s.close()
+
+	conn, err := ssh.Dial("tcp", s.address, s.config)
+	if err != nil {
+		return err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.conn, s.client = conn, client
+
+	return nil
+}
+
+func (s *SFTPStorage) close() {
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *SFTPStorage) filename(key string) string {
+	return path.Join(s.root, key)
+}
+
+// Put uploads r to key through a .part file that is renamed once complete. When r can seek,
+// an upload interrupted during this Put is resumed from the size of the .part file, after reconnecting.
+// The first attempt truncates the .part file, which may be left over by an earlier upload of other bytes.
+func (s *SFTPStorage) Put(key string, r io.Reader, size int64) error {
+	filename := s.filename(key)
+	seeker, resumable := r.(io.Seeker)
+
+	var err error
+	for attempt := 1; attempt <= sftpUploadAttempts; attempt++ {
+		if attempt > 1 {
+			if !resumable {
+				break
+			}
+			if err := s.connect(); err != nil {
+				return err
+			}
+		}
+
+		if err = s.upload(filename, r, seeker, attempt > 1); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 {
+		info, err := s.client.Stat(filename + ".part")
+		if err != nil {
+			return err
+		}
+		if info.Size() != size {
+			s.client.Remove(filename + ".part")
+			return fmt.Errorf("uploaded %d bytes of %d", info.Size(), size)
+		}
+	}
+
+	s.client.Remove(filename)
+	return s.client.Rename(filename+".part", filename)
+}
+
+// upload writes r to the .part file of filename. With resume, it keeps the bytes the .part file
+// already holds and writes the rest of seeker after them.
+func (s *SFTPStorage) upload(filename string, r io.Reader, seeker io.Seeker, resume bool) error {
+	if err := s.client.MkdirAll(path.Dir(filename)); err != nil {
+		return err
+	}
+
+	var offset int64
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		if info, err := s.client.Stat(filename + ".part"); err == nil {
+			offset = info.Size()
+		}
+		flags = os.O_WRONLY | os.O_CREATE
+	}
+
+	if seeker != nil {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	file, err := s.client.OpenFile(filename+".part", flags)
+	if err != nil {
+		return err
+	}
+
+	// sftp writes at the offset of the client, servers differ on whether O_APPEND overrides it
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Get downloads key
+func (s *SFTPStorage) Get(key string) (io.ReadCloser, error) {
+	return s.client.Open(s.filename(key))
+}
+
+// List returns the files whose key starts with prefix, sorted by key. Leftover .part files are not listed.
+func (s *SFTPStorage) List(prefix string) ([]StorageObject, error) {
+	start := path.Dir(s.filename(prefix + "x"))
+
+	var objects []StorageObject
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := s.client.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			p := path.Join(dir, entry.Name())
+			if entry.IsDir() {
+				if err := walk(p); err != nil {
+					return err
+				}
+				continue
+			}
+
+			key := strings.TrimPrefix(p, strings.TrimSuffix(s.root, "/")+"/")
+			if strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".part") {
+				objects = append(objects, StorageObject{Key: key, Size: entry.Size(), ModTime: entry.ModTime()})
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(start); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+// Delete removes key and then the directories left empty above it
+func (s *SFTPStorage) Delete(key string) error {
+	filename := s.filename(key)
+	if err := s.client.Remove(filename); err != nil {
+		return err
+	}
+
+	for dir := path.Dir(filename); dir != s.root && strings.HasPrefix(dir, s.root); dir = path.Dir(dir) {
+		if s.client.RemoveDirectory(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *SFTPStorage) String() string {
+	return "sftp://" + s.config.User + "@" + s.address + s.root
+}
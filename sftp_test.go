@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTPServer runs an ssh server accepting any client and serving the sftp subsystem
+// on the local filesystem, it returns its address
+func startSFTPServer(t *testing.T) string {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for request := range requests {
+				ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if ok {
+					if server, err := sftp.NewServer(channel); err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func newTestSFTPStorage(t *testing.T) *SFTPStorage {
+	t.Helper()
+
+	storage := &SFTPStorage{
+		address: startSFTPServer(t),
+		root:    t.TempDir(),
+		config: &ssh.ClientConfig{
+			User:            "backup",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+	}
+	if err := storage.connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(storage.close)
+
+	return storage
+}
+
+// failingReader reads from a bytes.Reader and fails once, after failAfter bytes
+type failingReader struct {
+	reader    *bytes.Reader
+	failAfter int64
+	failed    bool
+}
+
+func (f *failingReader) Seek(offset int64, whence int) (int64, error) {
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	position, _ := f.reader.Seek(0, io.SeekCurrent)
+	if !f.failed && position >= f.failAfter {
+		f.failed = true
+		return 0, errors.New("connection lost")
+	}
+	if !f.failed && position+int64(len(p)) > f.failAfter {
+		p = p[:f.failAfter-position]
+	}
+	return f.reader.Read(p)
+}
+
+func TestSFTPStoragePutResumes(t *testing.T) {
+	storage := newTestSFTPStorage(t)
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	reader := &failingReader{reader: bytes.NewReader(content), failAfter: 40000}
+
+	if err := storage.Put("daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", reader, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !reader.failed {
+		t.Fatal("the upload was not interrupted")
+	}
+
+	uploaded, err := ioutil.ReadFile(filepath.Join(storage.root, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, content) {
+		t.Errorf("resumed upload holds %d bytes differing from the %d bytes uploaded", len(uploaded), len(content))
+	}
+}
+
+func TestSFTPStoragePutIgnoresStalePart(t *testing.T) {
+	storage := newTestSFTPStorage(t)
+
+	filename := filepath.Join(storage.root, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// an upload of an earlier run of the day, interrupted after 4 bytes
+	if err := ioutil.WriteFile(filename+".part", []byte("OLD-"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("new archive of the same key")
+	if err := storage.Put("daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uploaded, content) {
+		t.Errorf("uploaded file = %q, want %q", uploaded, content)
+	}
+}
+
+func TestSFTPStorageListDelete(t *testing.T) {
+	storage := newTestSFTPStorage(t)
+
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "shop")
+	putString(t, storage, "daily/2017-08-05/crm-2017-08-05/crm_ALL_20170805.sql.gz", "crm")
+	if err := ioutil.WriteFile(filepath.Join(storage.root, "daily/2017-08-05/shop-2017-08-05/leftover.sql.gz.part"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"daily/2017-08-05/crm-2017-08-05/crm_ALL_20170805.sql.gz", "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"}
+	if got := listKeys(t, storage, "daily/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("List(daily/) = %v, want %v", got, want)
+	}
+
+	if got := getString(t, storage, "daily/2017-08-05/crm-2017-08-05/crm_ALL_20170805.sql.gz"); got != "crm" {
+		t.Errorf("Get = %q, want %q", got, "crm")
+	}
+
+	if err := DeleteStorageDir(storage, "daily/2017-08-05/crm-2017-08-05"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storage.root, "daily/2017-08-05/crm-2017-08-05")); !os.IsNotExist(err) {
+		t.Errorf("empty directory was not removed: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Snapshot model for the sessions reading the same point in time of a database.
+// The sessions are shared by the snapshots of every database of a run.
+type Snapshot struct {
+	Database string
+	Binlog   BinlogCoordinates
+
+	pool *snapshotPool
+}
+
+// snapshotPool model for the consistent snapshot sessions of a run, closed with the last snapshot using it
+type snapshotPool struct {
+	db       *sql.DB
+	sessions chan *snapshotSession
+
+	mu   sync.Mutex
+	refs int
+}
+
+// BinlogCoordinates model for the binlog position of a backup, empty when binlog is disabled
+type BinlogCoordinates struct {
+	File     string
+	Position string
+	GTIDSet  string
+}
+
+// snapshotSession is one connection inside a START TRANSACTION WITH CONSISTENT SNAPSHOT transaction
+type snapshotSession struct {
+	conn *sql.Conn
+}
+
+func (s *snapshotSession) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (s *snapshotSession) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// snapshotSessions returns the number of snapshot sessions of a run backing up databases: no more than the dumps
+// that can run at the same time, as they are all opened under the global read lock and held until the run ends
+func snapshotSessions(options Options, databases int) int {
+	sessions := options.Parallel
+	if options.ParallelPerDatabase > 0 && options.ParallelPerDatabase*databases < sessions {
+		sessions = options.ParallelPerDatabase * databases
+	}
+	if sessions < 1 {
+		sessions = 1
+	}
+
+	return sessions
+}
+
+// OpenSnapshots takes one global read lock, opens sessions consistent snapshot transactions shared by the databases,
+// records the binlog coordinates and releases the lock, so that all the snapshots read the same point in time.
+// The lock waits for the running queries of the server and blocks its writes meanwhile: open the snapshots before the dumps start.
+func OpenSnapshots(options Options, databases []string, sessions int) (map[string]*Snapshot, error) {
+	ctx := context.Background()
+
+	dsn, err := nativeDataSourceName(options, "")
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer lock.Close()
+
+	if _, err := lock.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer lock.ExecContext(ctx, "UNLOCK TABLES")
+
+	pool, err := openSnapshotPool(ctx, db, sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	binlog, err := GetBinlogCoordinates(&snapshotSession{conn: lock})
+	if err != nil {
+		pool.close()
+		return nil, err
+	}
+
+	snapshots := map[string]*Snapshot{}
+	for _, database := range databases {
+		snapshots[database] = &Snapshot{Database: database, Binlog: binlog, pool: pool}
+	}
+	pool.refs = len(snapshots)
+
+	return snapshots, nil
+}
+
+// openSnapshotPool opens sessions consistent snapshot transactions on db, call it under the global read lock.
+// db is closed with the pool, or when the opening fails.
+func openSnapshotPool(ctx context.Context, db *sql.DB, sessions int) (pool *snapshotPool, err error) {
+	pool = &snapshotPool{db: db, sessions: make(chan *snapshotSession, sessions)}
+
+	defer func() {
+		if err != nil {
+			pool.close()
+		}
+	}()
+
+	for i := 0; i < sessions; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		pool.sessions <- &snapshotSession{conn: conn}
+
+		if _, err = conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+			return nil, err
+		}
+
+		if _, err = conn.ExecContext(ctx, "START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */"); err != nil {
+			return nil, err
+		}
+	}
+
+	return pool, nil
+}
+
+// close ends the snapshot transactions and closes their connections
+func (p *snapshotPool) close() error {
+	ctx := context.Background()
+
+	close(p.sessions)
+	for session := range p.sessions {
+		session.conn.ExecContext(ctx, "ROLLBACK")
+		session.conn.Close()
+	}
+
+	return p.db.Close()
+}
+
+// GetBinlogCoordinates reads the current binlog position, call it under a global read lock for an exact position
+func GetBinlogCoordinates(q queryer) (BinlogCoordinates, error) {
+	var binlog BinlogCoordinates
+
+	rows, err := q.Query("SHOW MASTER STATUS")
+	if err != nil {
+		// MySQL 8.4 and later
+		rows, err = q.Query("SHOW BINARY LOG STATUS")
+		if err != nil {
+			return binlog, err
+		}
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return binlog, err
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	if rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return binlog, err
+		}
+
+		for i, column := range columns {
+			switch column {
+			case "File":
+				binlog.File = string(values[i])
+			case "Position":
+				binlog.Position = string(values[i])
+			case "Executed_Gtid_Set":
+				binlog.GTIDSet = strings.Replace(string(values[i]), "\n", "", -1)
+			}
+		}
+	}
+
+	return binlog, rows.Err()
+}
+
+// Acquire blocks until a session of the snapshot is free and makes the database of the snapshot its default one.
+// The consistent snapshot of a session covers every database, USE does not end its transaction.
+func (s *Snapshot) Acquire() (*snapshotSession, error) {
+	session := <-s.pool.sessions
+
+	if _, err := session.conn.ExecContext(context.Background(), "USE "+quoteIdentifier(s.Database)); err != nil {
+		s.Release(session)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Release gives back a session taken with Acquire
+func (s *Snapshot) Release(session *snapshotSession) {
+	s.pool.sessions <- session
+}
+
+// Close releases the snapshot of the database, the sessions are closed with the snapshot of the last database
+func (s *Snapshot) Close() error {
+	s.pool.mu.Lock()
+	s.pool.refs--
+	last := s.pool.refs == 0
+	s.pool.mu.Unlock()
+
+	if last {
+		return s.pool.close()
+	}
+
+	return nil
+}
+
+// snapshotHolder hands the snapshot of a database, opened by OpenSnapshots before the dumps start, to its jobs.
+// A nil snapshotHolder stands for a backup without snapshot.
+type snapshotHolder struct {
+	opened func(snapshot *Snapshot)
+
+	mu       sync.Mutex
+	snapshot *Snapshot
+	err      error
+	closed   bool
+}
+
+// newSnapshotHolder returns a new snapshotHolder instance, opened is called once the snapshot is set
+func newSnapshotHolder(opened func(snapshot *Snapshot)) *snapshotHolder {
+	return &snapshotHolder{opened: opened}
+}
+
+// Set stores the snapshot of the database or the error of its opening
+func (h *snapshotHolder) Set(snapshot *Snapshot, err error) {
+	h.mu.Lock()
+	h.snapshot, h.err = snapshot, err
+	h.mu.Unlock()
+
+	if err == nil && h.opened != nil {
+		h.opened(snapshot)
+	}
+}
+
+// Get returns the snapshot, or the error of a failed opening
+func (h *snapshotHolder) Get() (*Snapshot, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.snapshot == nil && h.err == nil {
+		return nil, errors.New("consistent snapshot not opened")
+	}
+
+	return h.snapshot, h.err
+}
+
+// Close closes the snapshot if it was opened
+func (h *snapshotHolder) Close() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.snapshot != nil && !h.closed {
+		h.closed = true
+		h.snapshot.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotSessions(t *testing.T) {
+	tests := []struct {
+		name        string
+		parallel    int
+		perDatabase int
+		databases   int
+		want        int
+	}{
+		{"one database", 4, 0, 1, 4},
+		{"many databases share parallel", 8, 0, 50, 8},
+		{"per database cap", 8, 1, 3, 3},
+		{"per database cap above parallel", 8, 2, 50, 8},
+		{"parallel below one", 0, 0, 5, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := Options{Parallel: test.parallel, ParallelPerDatabase: test.perDatabase}
+			if got := snapshotSessions(options, test.databases); got != test.want {
+				t.Errorf("snapshotSessions(%d databases) = %d, want %d", test.databases, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotPoolSessions(t *testing.T) {
+	db, err := sql.Open("mars-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeExecs = nil
+	pool, err := openSnapshotPool(context.Background(), db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.refs = 2
+
+	started := 0
+	for _, statement := range fakeExecs {
+		if strings.HasPrefix(statement, "START TRANSACTION") {
+			started++
+		}
+	}
+	if started != 3 {
+		t.Errorf("%d snapshot transactions started, want 3: %q", started, fakeExecs)
+	}
+
+	shop := &Snapshot{Database: "shop", pool: pool}
+	blog := &Snapshot{Database: "blog", pool: pool}
+
+	fakeExecs = nil
+	session, err := shop.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeExecs) != 1 || fakeExecs[0] != "USE `shop`" {
+		t.Errorf("Acquire executed %q, want USE `shop`", fakeExecs)
+	}
+	shop.Release(session)
+
+	if err := shop.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.sessions) != 3 {
+		t.Errorf("sessions closed with the snapshot of shop, still used by blog")
+	}
+
+	fakeExecs = nil
+	if err := blog.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rollbacks := strings.Count(strings.Join(fakeExecs, "\n"), "ROLLBACK"); rollbacks != 3 {
+		t.Errorf("%d sessions rolled back with the last snapshot, want 3", rollbacks)
+	}
+}
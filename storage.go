@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Storage is where the backup tree is kept. Keys are slash separated paths relative to its root,
+// e.g. daily/2017-08-05/mysql-2017-08-05/mysql_SCHEMA_20170805.sql.gz
+type Storage interface {
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, error)
+	List(prefix string) ([]StorageObject, error)
+	Delete(key string) error
+	String() string
+}
+
+// StorageObject model for one file listed by a Storage
+type StorageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+
+	// ID is shared by the keys holding the same bytes, e.g. hardlinks. Empty when each key has its own bytes.
+	ID string
+}
+
+// NewStorage returns the Storage described by options.Storage: the output directory when it is empty,
+// an S3 compatible bucket for s3://bucket/prefix or an SSH host for sftp://user@host[:port]/path
+func NewStorage(options Options) (Storage, error) {
+	if options.Storage == "" {
+		return &LocalStorage{Root: options.OutputDirectory}, nil
+	}
+
+	if strings.HasPrefix(options.Storage, "sftp://") {
+		return NewSFTPStorage(options.Storage, options.SFTPKey, options.SFTPKnownHosts)
+	}
+
+	if !strings.HasPrefix(options.Storage, "s3://") {
+		return nil, fmt.Errorf("unsupported storage %q, expected s3://bucket/prefix or sftp://user@host/path", options.Storage)
+	}
+
+	location := strings.TrimPrefix(options.Storage, "s3://")
+	bucket, prefix := location, ""
+	if i := strings.Index(location, "/"); i >= 0 {
+		bucket, prefix = location[:i], strings.Trim(location[i+1:], "/")
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("storage %q has no bucket", options.Storage)
+	}
+
+	return NewS3Storage(options.S3Endpoint, options.S3Region, !options.S3Insecure, bucket, prefix)
+}
+
+// LocalStorage keeps the backup tree in a directory
+type LocalStorage struct {
+	Root string
+}
+
+func (l *LocalStorage) filename(key string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(key))
+}
+
+// Put writes r to key, through a temporary file so a key is never seen half written
+func (l *LocalStorage) Put(key string, r io.Reader, size int64) error {
+	filename := l.filename(key)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(filename + ".tmp")
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+// Get opens key for reading
+func (l *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(l.filename(key))
+}
+
+// List returns the files whose key starts with prefix, sorted by key
+func (l *LocalStorage) List(prefix string) ([]StorageObject, error) {
+	start := l.filename(prefix)
+	if info, err := os.Stat(start); err != nil || !info.IsDir() {
+		start = filepath.Dir(start)
+	}
+
+	var objects []StorageObject
+	err := filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, StorageObject{Key: key, Size: info.Size(), ModTime: info.ModTime(), ID: fileID(info)})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+// Delete removes key and then the directories left empty above it
+func (l *LocalStorage) Delete(key string) error {
+	filename := l.filename(key)
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	root := filepath.Clean(l.Root)
+	for dir := filepath.Dir(filename); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Link makes dst share the bytes of src: a hardlink, a reflink when the filesystem refuses hardlinks,
+// or a copy when neither is possible, e.g. across filesystems. Archives are never modified in place,
+// as Put replaces a file by a new one, so sharing their bytes is safe.
+func (l *LocalStorage) Link(src string, dst string) (string, error) {
+	srcFile, dstFile := l.filename(src), l.filename(dst)
+	if err := os.MkdirAll(filepath.Dir(dstFile), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	// a promotion done again the same day replaces the files of the first one
+	if err := os.Remove(dstFile); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := os.Link(srcFile, dstFile); err == nil {
+		return "hardlink", nil
+	}
+
+	if err := reflinkFile(srcFile, dstFile); err == nil {
+		return "reflink", nil
+	}
+
+	file, err := os.Open(srcFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return "copy", l.Put(dst, file, -1)
+}
+
+func (l *LocalStorage) String() string {
+	return l.Root
+}
+
+// S3Storage keeps the backup tree below a prefix of an S3 compatible bucket
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Storage returns a new S3Storage instance. Credentials are read from the
+// AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY or MINIO_ACCESS_KEY/MINIO_SECRET_KEY environment variables.
+func NewS3Storage(endpoint string, region string, secure bool, bucket string, prefix string) (*S3Storage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		}),
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *S3Storage) objectName(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+// Put uploads r to key, size may be -1 when it is unknown
+func (s *S3Storage) Put(key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(key), r, size, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// Get downloads key
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject sends no request, a missing key would only fail the first read
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// List returns the objects whose key starts with prefix, sorted by key
+func (s *S3Storage) List(prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+
+	for info := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: s.objectName(prefix), Recursive: true}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+
+		key := info.Key
+		if s.prefix != "" {
+			key = strings.TrimPrefix(key, s.prefix+"/")
+		}
+		objects = append(objects, StorageObject{Key: key, Size: info.Size, ModTime: info.LastModified})
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+// Delete removes key
+func (s *S3Storage) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
+
+// s3MaxCopySize is the largest object copied by a single CopyObject request
+const s3MaxCopySize = 5 << 30
+
+// Link copies src to dst inside the bucket without downloading it, larger objects than s3MaxCopySize are copied in parts
+func (s *S3Storage) Link(src string, dst string) (string, error) {
+	ctx := context.Background()
+	source := minio.CopySrcOptions{Bucket: s.bucket, Object: s.objectName(src)}
+	destination := minio.CopyDestOptions{Bucket: s.bucket, Object: s.objectName(dst)}
+
+	info, err := s.client.StatObject(ctx, s.bucket, source.Object, minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if info.Size <= s3MaxCopySize {
+		_, err = s.client.CopyObject(ctx, destination, source)
+	} else {
+		_, err = s.client.ComposeObject(ctx, destination, source)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return "server-side copy", nil
+}
+
+func (s *S3Storage) String() string {
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+// StorageDirs returns the directories directly below prefix, each with the time of its newest file
+func StorageDirs(storage Storage, prefix string) (map[string]time.Time, error) {
+	objects, err := storage.List(prefix + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := map[string]time.Time{}
+	for _, object := range objects {
+		rest := strings.TrimPrefix(object.Key, prefix+"/")
+		i := strings.Index(rest, "/")
+		if i <= 0 {
+			continue
+		}
+
+		dir := prefix + "/" + rest[:i]
+		if object.ModTime.After(dirs[dir]) {
+			dirs[dir] = object.ModTime
+		}
+	}
+
+	return dirs, nil
+}
+
+// storageLinker is implemented by the storages able to copy a key without duplicating its bytes,
+// or without moving them through the backup host. Link returns the method used: hardlink, reflink,
+// server-side copy or copy.
+type storageLinker interface {
+	Link(src string, dst string) (string, error)
+}
+
+// CopyStorageDir copies every file below src to dst with Link when storage is a storageLinker, or else downloads and uploads them.
+// It returns the number of files copied by each method.
+func CopyStorageDir(storage Storage, src string, dst string) (map[string]int, error) {
+	objects, err := storage.List(src + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	methods := map[string]int{}
+
+	for _, object := range objects {
+		if linker, ok := storage.(storageLinker); ok {
+			method, err := linker.Link(object.Key, dst+strings.TrimPrefix(object.Key, src))
+			if err != nil {
+				return methods, err
+			}
+			methods[method]++
+			continue
+		}
+
+		reader, err := storage.Get(object.Key)
+		if err != nil {
+			return methods, err
+		}
+
+		err = storage.Put(dst+strings.TrimPrefix(object.Key, src), reader, object.Size)
+		reader.Close()
+		if err != nil {
+			return methods, err
+		}
+		methods["copy"]++
+	}
+
+	return methods, nil
+}
+
+// DeleteStorageDir removes every file below prefix
+func DeleteStorageDir(storage Storage, prefix string) error {
+	objects, err := storage.List(prefix + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		if err := storage.Delete(object.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UploadDirectory puts every file of the local directory dir to storage below prefix.
+// The manifest goes last, so a directory with a manifest in storage is complete.
+func UploadDirectory(storage Storage, dir string, prefix string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && entry.Name() != ManifestFilename {
+			names = append(names, entry.Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestFilename)); err == nil {
+		names = append(names, ManifestFilename)
+	}
+
+	for _, name := range names {
+		if err := uploadFile(storage, filepath.Join(dir, name), prefix+"/"+name); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func uploadFile(storage Storage, filename string, key string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return storage.Put(key, file, info.Size())
+}
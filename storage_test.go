@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func putString(t *testing.T, storage Storage, key string, content string) {
+	t.Helper()
+	if err := storage.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+}
+
+func getString(t *testing.T, storage Storage, key string) string {
+	t.Helper()
+	reader, err := storage.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	return string(content)
+}
+
+func listKeys(t *testing.T, storage Storage, prefix string) []string {
+	t.Helper()
+	objects, err := storage.List(prefix)
+	if err != nil {
+		t.Fatalf("List(%s): %v", prefix, err)
+	}
+
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+func TestLocalStoragePutGet(t *testing.T) {
+	storage := &LocalStorage{Root: t.TempDir()}
+
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "first")
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "second")
+
+	if got := getString(t, storage, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"); got != "second" {
+		t.Errorf("Get = %q, want %q", got, "second")
+	}
+
+	if _, err := os.Stat(filepath.Join(storage.Root, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if _, err := storage.Get("daily/missing"); err == nil {
+		t.Errorf("Get of a missing key succeeded")
+	}
+}
+
+func TestLocalStorageList(t *testing.T) {
+	storage := &LocalStorage{Root: t.TempDir()}
+
+	for _, key := range []string{
+		"weekly/2017-07-31/shop-2017-07-31/shop_ALL_20170731.sql.gz",
+		"daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz",
+		"daily/2017-08-04/shop-2017-08-04/shop_ALL_20170804.sql.gz",
+		"daily/2017-08-04/crm-2017-08-04/crm_ALL_20170804.sql.gz",
+	} {
+		putString(t, storage, key, key)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"daily/", []string{
+			"daily/2017-08-04/crm-2017-08-04/crm_ALL_20170804.sql.gz",
+			"daily/2017-08-04/shop-2017-08-04/shop_ALL_20170804.sql.gz",
+			"daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz",
+		}},
+		{"daily/2017-08-04/shop", []string{"daily/2017-08-04/shop-2017-08-04/shop_ALL_20170804.sql.gz"}},
+		{"weekly/", []string{"weekly/2017-07-31/shop-2017-07-31/shop_ALL_20170731.sql.gz"}},
+		{"monthly/", nil},
+	}
+
+	for _, test := range tests {
+		if got := listKeys(t, storage, test.prefix); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("List(%s) = %v, want %v", test.prefix, got, test.want)
+		}
+	}
+
+	objects, err := storage.List("weekly/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Size != int64(len(objects[0].Key)) {
+		t.Errorf("List(weekly/) = %+v, want the size of the file", objects)
+	}
+}
+
+func TestLocalStorageDelete(t *testing.T) {
+	storage := &LocalStorage{Root: t.TempDir()}
+
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/a.sql.gz", "a")
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/b.sql.gz", "b")
+
+	if err := storage.Delete("daily/2017-08-05/shop-2017-08-05/a.sql.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storage.Root, "daily/2017-08-05/shop-2017-08-05")); err != nil {
+		t.Errorf("directory still holding a file was removed: %v", err)
+	}
+
+	if err := storage.Delete("daily/2017-08-05/shop-2017-08-05/b.sql.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storage.Root, "daily")); !os.IsNotExist(err) {
+		t.Errorf("empty directories were not removed: %v", err)
+	}
+	if _, err := os.Stat(storage.Root); err != nil {
+		t.Errorf("root was removed: %v", err)
+	}
+
+	if err := storage.Delete("daily/missing"); err == nil {
+		t.Errorf("Delete of a missing key succeeded")
+	}
+}
+
+func TestLocalStorageLink(t *testing.T) {
+	storage := &LocalStorage{Root: t.TempDir()}
+
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "archive")
+	putString(t, storage, "weekly/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "stale")
+
+	method, err := storage.Link("daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "weekly/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != "hardlink" {
+		t.Errorf("Link method = %s, want hardlink", method)
+	}
+
+	if got := getString(t, storage, "weekly/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"); got != "archive" {
+		t.Errorf("linked file = %q, want %q", got, "archive")
+	}
+
+	objects, err := storage.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].ID == "" || objects[0].ID != objects[1].ID {
+		t.Errorf("hardlinked files do not share their ID: %+v", objects)
+	}
+
+	// a new archive of the same day replaces the daily file without changing the linked copy
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "rerun")
+	if got := getString(t, storage, "weekly/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"); got != "archive" {
+		t.Errorf("linked file = %q after a new daily archive, want %q", got, "archive")
+	}
+}
+
+// copyOnlyStorage hides the Link method of the storage it wraps
+type copyOnlyStorage struct {
+	Storage
+}
+
+func TestCopyStorageDir(t *testing.T) {
+	local := &LocalStorage{Root: t.TempDir()}
+	putString(t, local, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz", "shop")
+	putString(t, local, "daily/2017-08-05/shop-2017-08-05/manifest.json", "{}")
+
+	tests := []struct {
+		storage Storage
+		dst     string
+		method  string
+	}{
+		{local, "weekly/2017-08-05", "hardlink"},
+		{copyOnlyStorage{local}, "monthly/2017-08-05", "copy"},
+	}
+
+	for _, test := range tests {
+		methods, err := CopyStorageDir(test.storage, "daily/2017-08-05", test.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(methods, map[string]int{test.method: 2}) {
+			t.Errorf("CopyStorageDir to %s methods = %v, want 2 %s", test.dst, methods, test.method)
+		}
+
+		want := []string{test.dst + "/shop-2017-08-05/manifest.json", test.dst + "/shop-2017-08-05/shop_ALL_20170805.sql.gz"}
+		if got := listKeys(t, local, test.dst+"/"); !reflect.DeepEqual(got, want) {
+			t.Errorf("CopyStorageDir to %s = %v, want %v", test.dst, got, want)
+		}
+	}
+}
+
+func TestDeleteStorageDir(t *testing.T) {
+	storage := &LocalStorage{Root: t.TempDir()}
+	putString(t, storage, "daily/2017-08-04/shop-2017-08-04/a.sql.gz", "a")
+	putString(t, storage, "daily/2017-08-05/shop-2017-08-05/b.sql.gz", "b")
+
+	if err := DeleteStorageDir(storage, "daily/2017-08-04"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := listKeys(t, storage, ""), []string{"daily/2017-08-05/shop-2017-08-05/b.sql.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after DeleteStorageDir = %v, want %v", got, want)
+	}
+}
+
+// fakeS3 is an S3 stand-in serving one bucket from memory: it lists, reads, writes and copies objects
+// and counts the object bytes received through uploads
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	uploaded int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+
+	key := parts[1]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		content, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf("%q", key))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(source)
+			content, ok := f.objects[strings.TrimPrefix(strings.TrimPrefix(source, "/"), f.bucket+"/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.objects[key] = content
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%q</ETag><LastModified>%s</LastModified></CopyObjectResult>", key, time.Now().UTC().Format(time.RFC3339))
+			return
+		}
+
+		content, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = content
+		f.uploaded += len(content)
+		w.Header().Set("ETag", fmt.Sprintf("%q", key))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+		ETag         string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix}
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{Key: key, Size: len(f.objects[key]), LastModified: time.Now().UTC().Format(time.RFC3339), ETag: fmt.Sprintf("%q", key)})
+	}
+	result.KeyCount = len(result.Contents)
+
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3StorageCopyStorageDir(t *testing.T) {
+	fake := &fakeS3{bucket: "backups", objects: map[string][]byte{
+		"mysql/daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz": []byte("shop"),
+		"mysql/daily/2017-08-05/shop-2017-08-05/manifest.json":            []byte("{}"),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "mars")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+
+	storage, err := NewS3Storage(strings.TrimPrefix(server.URL, "http://"), "us-east-1", false, "backups", "mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods, err := CopyStorageDir(storage, "daily/2017-08-05", "weekly/2017-08-05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(methods, map[string]int{"server-side copy": 2}) {
+		t.Errorf("CopyStorageDir methods = %v, want 2 server-side copies", methods)
+	}
+
+	if fake.uploaded != 0 {
+		t.Errorf("CopyStorageDir uploaded %d bytes, want a copy inside the bucket", fake.uploaded)
+	}
+
+	want := []string{"weekly/2017-08-05/shop-2017-08-05/manifest.json", "weekly/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"}
+	if got := listKeys(t, storage, "weekly/"); !reflect.DeepEqual(got, want) {
+		t.Errorf("List(weekly/) = %v, want %v", got, want)
+	}
+
+	if got := getString(t, storage, "weekly/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"); got != "shop" {
+		t.Errorf("copied object = %q, want %q", got, "shop")
+	}
+}
+
+func TestS3StorageGetMissingKey(t *testing.T) {
+	fake := &fakeS3{bucket: "backups", objects: map[string][]byte{
+		"mysql/daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz": []byte("shop"),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "mars")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+
+	storage, err := NewS3Storage(strings.TrimPrefix(server.URL, "http://"), "us-east-1", false, "backups", "mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reader, err := storage.Get("daily/2017-08-05/shop-2017-08-05/" + ManifestFilename); err == nil {
+		reader.Close()
+		t.Errorf("Get of a missing key succeeded")
+	} else if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get of a missing key = %v, want a not found error", err)
+	}
+
+	// a directory of an older version, without manifest, is taken as successful
+	if success, err := readManifestSuccess(storage, "daily/2017-08-05/shop-2017-08-05"); !success || err != nil {
+		t.Errorf("readManifestSuccess = %t, %v for a directory without manifest, want true", success, err)
+	}
+
+	if got := getString(t, storage, "daily/2017-08-05/shop-2017-08-05/shop_ALL_20170805.sql.gz"); got != "shop" {
+		t.Errorf("Get = %q, want %q", got, "shop")
+	}
+}
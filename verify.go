@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"filippo.io/age"
+)
+
+// dumpTrailer is the last comment mysqldump and the native engine write in a complete dump
+const dumpTrailer = "-- Dump completed"
+
+// VerifyOptions model for verify subcommand arguments
+type VerifyOptions struct {
+	Path         string
+	CheckTrailer bool
+	Identities   []age.Identity
+	Verbosity    int
+}
+
+// VerifyResult model for the verification of one archive
+type VerifyResult struct {
+	File    string
+	Err     error
+	Warning string
+}
+
+// tailWriter keeps the last bytes written to it
+type tailWriter struct {
+	size int
+	buf  []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = t.buf[len(t.buf)-t.size:]
+	}
+	return len(p), nil
+}
+
+// GetVerifyOptions creates VerifyOptions type from the verify subcommand arguments
+func GetVerifyOptions(arguments []string) *VerifyOptions {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [options] <backup dir>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var checktrailer bool
+	flags.BoolVar(&checktrailer, "check-trailer", true, "Check that every dump ends with the \""+dumpTrailer+"\" comment. Disable for dumps made with --skip-comments")
+
+	var identityfile string
+	flags.StringVar(&identityfile, "identity", "", "age identity file holding the private keys of encrypted backup files. Without it only their checksum is verified")
+
+	var passphrasefile string
+	flags.StringVar(&passphrasefile, "passphrase-file", "", "File holding the passphrase of encrypted backup files in its first line")
+
+	var verbosity int
+	flags.IntVar(&verbosity, "verbosity", 2, "0 = only errors, 1 = important things, 2 = all")
+
+	var logformat, logfile string
+	defineLogFlags(flags, &logformat, &logfile)
+
+	flags.Parse(arguments)
+
+	if err := SetupLogging(logformat, logfile); err != nil {
+		printMessage(err.Error(), verbosity, Error)
+		os.Exit(1)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	identities, err := LoadIdentities(identityfile, passphrasefile)
+	if err != nil {
+		printMessage("error to load decryption keys: "+err.Error(), verbosity, Error)
+		os.Exit(1)
+	}
+
+	return &VerifyOptions{
+		Path:         flags.Arg(0),
+		CheckTrailer: checktrailer,
+		Identities:   identities,
+		Verbosity:    verbosity,
+	}
+}
+
+// Verify checks every backup directory found under options.Path and returns the process exit code
+func Verify(options VerifyOptions) int {
+	dirs, err := backupDirectories(options.Path)
+	if err != nil {
+		printMessage("error to read "+options.Path+": "+err.Error(), options.Verbosity, Error)
+		return 4
+	}
+
+	if len(dirs) == 0 {
+		printMessage("no backup archives found in "+options.Path, options.Verbosity, Error)
+		return 4
+	}
+
+	total, failed := 0, 0
+	for _, dir := range dirs {
+		printMessage("Verifying backup directory : "+dir, options.Verbosity, Info)
+
+		for _, result := range VerifyDirectory(dir, options.CheckTrailer, options.Identities) {
+			total++
+
+			switch {
+			case result.Err != nil:
+				failed++
+				printMessage("FAILED : "+result.File+" : "+result.Err.Error(), options.Verbosity, Error)
+			case result.Warning != "":
+				printMessage("WARNING : "+result.File+" : "+result.Warning, options.Verbosity, Warning)
+			default:
+				printMessage("OK : "+result.File, options.Verbosity, Info)
+			}
+		}
+	}
+
+	if failed > 0 {
+		printMessage(fmt.Sprintf("Verification failed : %d of %d checks failed", failed, total), options.Verbosity, Error)
+		return 4
+	}
+
+	printMessage(fmt.Sprintf("Verification successfull : %d checks passed", total), options.Verbosity, Info)
+	return 0
+}
+
+// backupDirectories returns root and every directory below it that holds archives or a manifest
+func backupDirectories(root string) ([]string, error) {
+	found := map[string]bool{}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// the archives of a run in progress, or of an interrupted one
+		if info.IsDir() && info.Name() == stagingDirectoryName && p != root {
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() && (IsArchive(info.Name()) || info.Name() == ManifestFilename) {
+			found[filepath.Dir(p)] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for dir := range found {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs, nil
+}
+
+// VerifyDirectory checks the archives of one database backup directory, against its manifest when it has one.
+// Encrypted archives are only checked against the manifest checksum when identities is empty.
+func VerifyDirectory(dir string, checkTrailer bool, identities []age.Identity) []VerifyResult {
+	var results []VerifyResult
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return []VerifyResult{{File: dir, Err: err}}
+	}
+
+	listed := map[string]ManifestFile{}
+
+	manifest, err := ReadManifest(dir)
+	switch {
+	case err == nil:
+		for _, file := range manifest.Files {
+			listed[file.File] = file
+		}
+
+		result := VerifyResult{File: filepath.Join(dir, ManifestFilename)}
+		if manifest.Status != ManifestStatusSuccess {
+			result.Err = fmt.Errorf("backup run ended with status %q", manifest.Status)
+		}
+		results = append(results, result)
+	case os.IsNotExist(err):
+		manifest = nil
+	default:
+		results = append(results, VerifyResult{File: filepath.Join(dir, ManifestFilename), Err: err})
+		manifest = nil
+	}
+
+	present := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() || !IsArchive(entry.Name()) {
+			continue
+		}
+		present[entry.Name()] = true
+
+		result := VerifyResult{File: filepath.Join(dir, entry.Name())}
+
+		checksum, size, err := VerifyArchive(result.File, checkTrailer, identities)
+		if err != nil {
+			result.Err = err
+		} else if manifest != nil {
+			file, ok := listed[entry.Name()]
+			switch {
+			case !ok:
+				result.Warning = "not listed in " + ManifestFilename
+			case file.SHA256 != checksum:
+				result.Err = fmt.Errorf("SHA-256 is %s, manifest has %s", checksum, file.SHA256)
+			case size >= 0 && file.UncompressedSize != size:
+				result.Err = fmt.Errorf("uncompressed size is %d, manifest has %d", size, file.UncompressedSize)
+			}
+		}
+
+		if result.Err == nil && result.Warning == "" && size < 0 {
+			result.Warning = "encrypted, content not checked without -identity or -passphrase-file"
+		}
+
+		results = append(results, result)
+	}
+
+	if manifest != nil {
+		for _, file := range manifest.Files {
+			if !present[file.File] {
+				results = append(results, VerifyResult{File: filepath.Join(dir, file.File), Err: fmt.Errorf("listed in %s but missing", ManifestFilename)})
+			}
+		}
+	}
+
+	return results
+}
+
+// VerifyArchive reads a whole archive, validating its encryption, compression and tar framing
+// and optionally the dump trailer. It returns the SHA-256 of the archive and the size of the dump it holds,
+// or -1 for an encrypted archive that identities can not open, of which only the checksum is computed.
+func VerifyArchive(filename string, checkTrailer bool, identities []age.Identity) (string, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	tee := io.TeeReader(file, hash)
+
+	if IsEncrypted(filename) && len(identities) == 0 {
+		if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+			return "", 0, err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), -1, nil
+	}
+
+	reader, err := NewArchiveReader(tee, filename, identities)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+
+	tail := &tailWriter{size: 1024}
+	size, err := io.Copy(tail, reader)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// hash the bytes the decompressor did not need to read
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return "", 0, err
+	}
+
+	if checkTrailer && !bytes.Contains(tail.buf, []byte(dumpTrailer)) {
+		return "", 0, fmt.Errorf("dump does not end with %q, it is probably truncated", dumpTrailer)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
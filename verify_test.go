@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// testDump is a complete dump, ending with the trailer of mysqldump
+const testDump = "CREATE TABLE `orders` (`id` int);\nINSERT INTO `orders` VALUES (1),(2),(3);\n" + dumpTrailer + " on 2017-08-05 10:00:00\n"
+
+// writeTestArchive writes content to the archive dir/name with codec, encrypted when recipients are given,
+// and returns its manifest entry
+func writeTestArchive(t *testing.T, dir string, name string, codec string, recipients []age.Recipient, content string) ManifestFile {
+	t.Helper()
+
+	archive, err := CreateArchive(filepath.Join(dir, name), codec, mustCodec(t, codec).DefaultLevel, recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archive.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ManifestFile{
+		File:             name,
+		Compression:      codec,
+		Encrypted:        len(recipients) > 0,
+		Kind:             KindAll,
+		Size:             archive.Size(),
+		UncompressedSize: archive.UncompressedSize(),
+		SHA256:           archive.SHA256(),
+	}
+}
+
+func mustCodec(t *testing.T, name string) Codec {
+	t.Helper()
+	codec, ok := GetCodec(name)
+	if !ok {
+		t.Fatalf("unknown codec %q", name)
+	}
+	return codec
+}
+
+// truncateFile cuts filename to half of its size
+func truncateFile(t *testing.T, filename string) {
+	t.Helper()
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	tests := []struct {
+		name         string
+		codec        string
+		content      string
+		truncate     bool
+		checkTrailer bool
+		wantErr      string
+	}{
+		{name: "clean gzip", codec: "gzip", content: testDump, checkTrailer: true},
+		{name: "clean zstd", codec: "zstd", content: testDump, checkTrailer: true},
+		{name: "truncated gzip", codec: "gzip", content: testDump, truncate: true, checkTrailer: true, wantErr: "EOF"},
+		{name: "truncated zstd", codec: "zstd", content: testDump, truncate: true, checkTrailer: true, wantErr: "EOF"},
+		{name: "truncated xz", codec: "xz", content: testDump, truncate: true, checkTrailer: true, wantErr: "EOF"},
+		{name: "missing trailer", codec: "gzip", content: "CREATE TABLE `orders` (`id` int);\n", checkTrailer: true, wantErr: dumpTrailer},
+		{name: "missing trailer not checked", codec: "gzip", content: "CREATE TABLE `orders` (`id` int);\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := "shop_ALL_20170805" + mustCodec(t, test.codec).Extension
+			file := writeTestArchive(t, dir, name, test.codec, nil, test.content)
+			if test.truncate {
+				truncateFile(t, filepath.Join(dir, name))
+			}
+
+			checksum, size, err := VerifyArchive(filepath.Join(dir, name), test.checkTrailer, nil)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("VerifyArchive error = %v, want an error containing %q", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("VerifyArchive: %v", err)
+			}
+			if checksum != file.SHA256 || size != file.UncompressedSize {
+				t.Errorf("VerifyArchive = %s, %d, want %s, %d", checksum, size, file.SHA256, file.UncompressedSize)
+			}
+		})
+	}
+}
+
+func TestVerifyDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string, manifest *Manifest)
+		wantErr map[string]string
+	}{
+		{
+			name:    "clean",
+			wantErr: map[string]string{},
+		},
+		{
+			name: "checksum mismatch",
+			corrupt: func(t *testing.T, dir string, manifest *Manifest) {
+				manifest.Files[1].SHA256 = strings.Repeat("0", 64)
+			},
+			wantErr: map[string]string{"shop_orders1_20170805.sql.gz": "SHA-256"},
+		},
+		{
+			name: "truncated archive",
+			corrupt: func(t *testing.T, dir string, manifest *Manifest) {
+				truncateFile(t, filepath.Join(dir, "shop_SCHEMA_20170805.sql.gz"))
+			},
+			wantErr: map[string]string{"shop_SCHEMA_20170805.sql.gz": "EOF"},
+		},
+		{
+			name: "missing archive",
+			corrupt: func(t *testing.T, dir string, manifest *Manifest) {
+				os.Remove(filepath.Join(dir, "shop_orders1_20170805.sql.gz"))
+			},
+			wantErr: map[string]string{"shop_orders1_20170805.sql.gz": "missing"},
+		},
+		{
+			name: "failed run",
+			corrupt: func(t *testing.T, dir string, manifest *Manifest) {
+				manifest.Status = ManifestStatusFailed
+			},
+			wantErr: map[string]string{ManifestFilename: "status"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			manifest := &Manifest{Database: "shop"}
+			manifest.AddFile(writeTestArchive(t, dir, "shop_SCHEMA_20170805.sql.gz", "gzip", nil, testDump))
+			manifest.AddFile(writeTestArchive(t, dir, "shop_orders1_20170805.sql.gz", "gzip", nil, testDump))
+
+			manifest.Status = ManifestStatusSuccess
+			if test.corrupt != nil {
+				test.corrupt(t, dir, manifest)
+			}
+			if err := manifest.Write(dir, manifest.Status); err != nil {
+				t.Fatal(err)
+			}
+
+			results := VerifyDirectory(dir, true, nil)
+			if len(results) != 3 {
+				t.Errorf("VerifyDirectory returned %d results, want the manifest and 2 archives", len(results))
+			}
+
+			for _, result := range results {
+				want, failed := test.wantErr[filepath.Base(result.File)]
+				switch {
+				case failed && (result.Err == nil || !strings.Contains(result.Err.Error(), want)):
+					t.Errorf("%s: error = %v, want an error containing %q", filepath.Base(result.File), result.Err, want)
+				case !failed && (result.Err != nil || result.Warning != ""):
+					t.Errorf("%s: error = %v, warning = %q, want none", filepath.Base(result.File), result.Err, result.Warning)
+				}
+			}
+		})
+	}
+}